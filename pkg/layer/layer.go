@@ -2,7 +2,9 @@
 package layer
 
 import (
+	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger"
@@ -11,6 +13,9 @@ import (
 //-----------------------------------------------------------------------------
 
 type (
+	// Iterator .
+	Iterator = badger.Iterator
+
 	// IteratorOptions .
 	IteratorOptions = badger.IteratorOptions
 
@@ -38,9 +43,11 @@ var (
 //-----------------------------------------------------------------------------
 // ManagedDB
 
-// ManagedDB .
+// ManagedDB is a DB with transaction timestamps managed by the user,
+// which supports the same hooks as DB.
 type ManagedDB struct {
 	*badger.ManagedDB
+	hookSet
 }
 
 // OpenManaged .
@@ -54,17 +61,53 @@ func OpenManaged(opts Options) (db *ManagedDB, err error) {
 	return
 }
 
-// GetSequence .
-func (db *ManagedDB) GetSequence(_ []byte, _ uint64) (*badger.Sequence, error) {
-	return db.ManagedDB.GetSequence(nil, 0)
+// GetSequence passes key and bandwidth to badger. Sequences lease ids
+// inside non-managed transactions, so badger returns ErrManagedTxn.
+func (db *ManagedDB) GetSequence(key []byte, bandwidth uint64) (*badger.Sequence, error) {
+	return db.ManagedDB.DB.GetSequence(key, bandwidth)
 }
 
-// NewTransaction .
-func (db *ManagedDB) NewTransaction(update bool) { db.ManagedDB.NewTransaction(update) }
+// NewTransaction creates a transaction, which reads the latest versions
+// of keys. A read-write transaction must be committed using CommitAt.
+func (db *ManagedDB) NewTransaction(update bool) *Txn {
+	return db.newTxn(db.ManagedDB.DB.NewTransaction(update), update)
+}
 
-// NewTransactionAt .
+// NewTransactionAt creates a transaction, which reads at readTs.
 func (db *ManagedDB) NewTransactionAt(readTs uint64, update bool) *Txn {
-	return newTxn(db.ManagedDB.NewTransactionAt(readTs, update))
+	return db.newTxn(db.ManagedDB.NewTransactionAt(readTs, update), update)
+}
+
+func (db *ManagedDB) newTxn(btxn *badger.Txn, update bool) *Txn {
+	var hooks txnConfig
+	if update {
+		hooks = db.hooks()
+	}
+	return newTxn(btxn, hooks)
+}
+
+// UpdateAt runs fn inside a read-write transaction, reading at readTs,
+// and commits it at commitTs, running the registered hooks.
+func (db *ManagedDB) UpdateAt(readTs, commitTs uint64, fn func(txn *Txn) error) error {
+	return db.UpdateAtWith(readTs, commitTs, fn, nil)
+}
+
+// UpdateAtWith is UpdateAt, which also runs beforeCommit
+// - see Txn.CommitAtWith.
+func (db *ManagedDB) UpdateAtWith(readTs, commitTs uint64, fn func(txn *Txn) error, beforeCommit BeforeCommit) error {
+	txn := db.NewTransactionAt(readTs, true)
+	defer txn.Discard()
+	if err := fn(txn); err != nil {
+		return err
+	}
+	return txn.CommitAtWith(commitTs, beforeCommit, nil)
+}
+
+// ViewAt runs fn inside a read-only transaction, reading at readTs.
+func (db *ManagedDB) ViewAt(readTs uint64, fn func(txn *Txn) error) error {
+	txn := db.NewTransactionAt(readTs, false)
+	defer txn.Discard()
+	return fn(txn)
 }
 
 //-----------------------------------------------------------------------------
@@ -72,7 +115,11 @@ func (db *ManagedDB) NewTransactionAt(readTs uint64, update bool) *Txn {
 
 // DB .
 type DB struct {
+	// first, for 64-bit alignment of atomic counters
+	retryStats RetryStats
+
 	*badger.DB
+	hookSet
 }
 
 // Open .
@@ -109,7 +156,11 @@ func (db *DB) Load(r io.Reader) error { return db.DB.Load(r) }
 
 // NewTransaction .
 func (db *DB) NewTransaction(update bool) *Txn {
-	return newTxn(db.DB.NewTransaction(update))
+	var hooks txnConfig
+	if update {
+		hooks = db.hooks()
+	}
+	return newTxn(db.DB.NewTransaction(update), hooks)
 }
 
 // RunValueLogGC .
@@ -123,35 +174,95 @@ func (db *DB) Size() (lsm int64, vlog int64) { return db.DB.Size() }
 // Tables .
 func (db *DB) Tables() []badger.TableInfo { return db.DB.Tables() }
 
-// Update .
+// Update runs fn inside a read-write transaction, and commits it,
+// running the registered BeforeCommit hooks.
 func (db *DB) Update(fn func(txn *Txn) error) error {
-	return db.DB.Update(func(btxn *badger.Txn) error {
-		return fn(newTxn(btxn))
-	})
+	return db.UpdateWith(fn, nil)
 }
 
 // View .
 func (db *DB) View(fn func(txn *Txn) error) error {
 	return db.DB.View(func(btxn *badger.Txn) error {
-		return fn(newTxn(btxn))
+		return fn(newTxn(btxn, txnConfig{}))
 	})
 }
 
+//-----------------------------------------------------------------------------
+
+// hookSet holds the hooks and options of a database, for its transactions.
+type hookSet struct {
+	mx           sync.RWMutex
+	beforeCommit []BeforeCommit
+	afterCommit  []AfterCommit
+	preImages    bool
+}
+
+// AddBeforeCommit registers hooks which are run before every commit
+// of read-write transactions, created after this call.
+func (h *hookSet) AddBeforeCommit(hooks ...BeforeCommit) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	for _, v := range hooks {
+		if v == nil {
+			continue
+		}
+		h.beforeCommit = append(h.beforeCommit, v)
+	}
+}
+
+// AddAfterCommit registers hooks which are run after every successful
+// commit of read-write transactions, created after this call.
+func (h *hookSet) AddAfterCommit(hooks ...AfterCommit) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	for _, v := range hooks {
+		if v == nil {
+			continue
+		}
+		h.afterCommit = append(h.afterCommit, v)
+	}
+}
+
+// EnablePreImages makes read-write transactions, created after this call,
+// to capture the value of each key before its first write (Mutation.Prev).
+// The previous value is read inside the transaction, so it also takes part
+// in conflict detection.
+func (h *hookSet) EnablePreImages() {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	h.preImages = true
+}
+
+func (h *hookSet) hooks() txnConfig {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+	return txnConfig{
+		beforeCommit: h.beforeCommit,
+		afterCommit:  h.afterCommit,
+		preImages:    h.preImages,
+	}
+}
+
 //-----------------------------------------------------------------------------
 // Txn
 
 // Txn .
 type Txn struct {
 	*badger.Txn
-	entries map[string][]byte
+	changes Changes
+	tracked bool
+	prevs   map[string][]byte
+	hooks   txnConfig
 }
 
-// Commit .
-func (txn *Txn) Commit(callback func(error)) error { return txn.Txn.Commit(callback) }
+// Commit runs the registered BeforeCommit hooks and commits the transaction,
+// and then runs the registered AfterCommit hooks.
+func (txn *Txn) Commit(callback func(error)) error { return txn.CommitWith(nil, callback) }
 
-// CommitAt .
+// CommitAt runs the registered BeforeCommit hooks and commits the transaction
+// at the given commit timestamp, and then runs the registered AfterCommit hooks.
 func (txn *Txn) CommitAt(commitTs uint64, callback func(error)) error {
-	return txn.Txn.CommitAt(commitTs, callback)
+	return txn.CommitAtWith(commitTs, nil, callback)
 }
 
 // Discard .
@@ -167,96 +278,269 @@ func (txn *Txn) NewIterator(opt IteratorOptions) *badger.Iterator {
 
 // Delete .
 func (txn *Txn) Delete(key []byte) error {
+	if err := txn.capture(key); err != nil {
+		return err
+	}
 	if err := txn.Txn.Delete(key); err != nil {
 		return err
 	}
-	txn.note(key, nil)
+	txn.note(Mutation{Op: OpDelete, Key: key})
 	return nil
 }
 
 // Set .
 func (txn *Txn) Set(key, val []byte) error {
+	if err := txn.capture(key); err != nil {
+		return err
+	}
 	if err := txn.Txn.Set(key, val); err != nil {
 		return err
 	}
-	txn.note(key, val)
+	txn.note(Mutation{Op: OpSet, Key: key, Value: val})
 	return nil
 }
 
 // SetEntry .
 func (txn *Txn) SetEntry(e *Entry) error {
+	if err := txn.capture(e.Key); err != nil {
+		return err
+	}
 	if err := txn.Txn.SetEntry(e); err != nil {
 		return err
 	}
-	txn.note(e.Key, e.Value)
+	txn.note(Mutation{Op: OpSet, Key: e.Key, Value: e.Value, UserMeta: e.UserMeta, ExpiresAt: e.ExpiresAt})
 	return nil
 }
 
 // SetWithDiscard .
 func (txn *Txn) SetWithDiscard(key, val []byte, meta byte) error {
+	if err := txn.capture(key); err != nil {
+		return err
+	}
 	if err := txn.Txn.SetWithDiscard(key, val, meta); err != nil {
 		return err
 	}
-	txn.note(key, val)
+	txn.note(Mutation{Op: OpSet, Key: key, Value: val, UserMeta: meta, Discard: true})
 	return nil
 }
 
 // SetWithMeta .
 func (txn *Txn) SetWithMeta(key, val []byte, meta byte) error {
+	if err := txn.capture(key); err != nil {
+		return err
+	}
 	if err := txn.Txn.SetWithMeta(key, val, meta); err != nil {
 		return err
 	}
-	txn.note(key, val)
+	txn.note(Mutation{Op: OpSet, Key: key, Value: val, UserMeta: meta})
 	return nil
 }
 
 // SetWithTTL .
 func (txn *Txn) SetWithTTL(key, val []byte, dur time.Duration) error {
-	if err := txn.Txn.SetWithTTL(key, val, dur); err != nil {
-		return err
-	}
-	txn.note(key, val)
-	return nil
+	// same as badger's SetWithTTL, with the entry recorded as it is set
+	return txn.SetEntry(&Entry{Key: key, Value: val, ExpiresAt: uint64(time.Now().Add(dur).Unix())})
 }
 
 //-----------------------------------------------------------------------------
 
-func newTxn(btxn *badger.Txn) (txn *Txn) {
-	txn = &Txn{Txn: btxn, entries: make(map[string][]byte)}
+// txnConfig are the hooks and options of a database,
+// when a transaction is created.
+type txnConfig struct {
+	beforeCommit []BeforeCommit
+	afterCommit  []AfterCommit
+	preImages    bool
+}
+
+func newTxn(btxn *badger.Txn, hooks txnConfig) (txn *Txn) {
+	txn = &Txn{Txn: btxn, tracked: true, hooks: hooks}
+	if hooks.preImages {
+		txn.prevs = make(map[string][]byte)
+	}
 	return
 }
 
-func (txn *Txn) note(key, val []byte) {
-	if txn.entries == nil {
+// capture reads the value of key before its first write in the transaction,
+// if pre-images are enabled.
+func (txn *Txn) capture(key []byte) error {
+	if !txn.tracked || txn.prevs == nil {
+		return nil
+	}
+	if _, ok := txn.prevs[string(key)]; ok {
+		return nil
+	}
+	var prev []byte
+	item, err := txn.Txn.Get(key)
+	switch err {
+	case nil:
+		if prev, err = item.ValueCopy(nil); err != nil {
+			return err
+		}
+		if prev == nil {
+			prev = []byte{}
+		}
+	case ErrKeyNotFound:
+	default:
+		return err
+	}
+	txn.prevs[string(key)] = prev
+	return nil
+}
+
+func (txn *Txn) note(m Mutation) {
+	if !txn.tracked {
 		return
 	}
-	txn.entries[string(key)] = val
-	return
+	if txn.prevs != nil {
+		m.Prev, m.HasPrev = txn.prevs[string(m.Key)], true
+	}
+	txn.changes = append(txn.changes, m)
 }
 
-// CommitWith .
+// CommitWith runs beforeCommit (if not nil) and then the registered
+// BeforeCommit hooks, and commits the transaction. After a successful
+// commit, the registered AfterCommit hooks are run - if callback is provided,
+// the commit is async, and they are run before callback.
 func (txn *Txn) CommitWith(beforeCommit BeforeCommit, callback func(error)) error {
-	entries := txn.entries
-	txn.entries = nil
-	if err := beforeCommit(txn, entries); err != nil {
+	changes, err := txn.runBeforeCommit(beforeCommit)
+	if err != nil {
+		return err
+	}
+	if callback != nil {
+		return txn.Txn.Commit(txn.afterCommitCallback(changes, 0, callback))
+	}
+	if err := txn.Txn.Commit(nil); err != nil {
 		return err
 	}
-	return txn.Txn.Commit(callback)
+	txn.runAfterCommit(changes, 0)
+	return nil
 }
 
-// CommitAtWith .
+// CommitAtWith is CommitWith, at the given commit timestamp.
 func (txn *Txn) CommitAtWith(commitTs uint64, beforeCommit BeforeCommit, callback func(error)) error {
-	entries := txn.entries
-	txn.entries = nil
-	if err := beforeCommit(txn, entries); err != nil {
+	changes, err := txn.runBeforeCommit(beforeCommit)
+	if err != nil {
 		return err
 	}
-	return txn.Txn.CommitAt(commitTs, callback)
+	if callback != nil {
+		return txn.Txn.CommitAt(commitTs, txn.afterCommitCallback(changes, commitTs, callback))
+	}
+	if err := txn.Txn.CommitAt(commitTs, nil); err != nil {
+		return err
+	}
+	txn.runAfterCommit(changes, commitTs)
+	return nil
+}
+
+// runBeforeCommit runs the BeforeCommit hooks, and returns the changes
+// written before the hooks - writes of the hooks are not tracked.
+func (txn *Txn) runBeforeCommit(beforeCommit BeforeCommit) (Changes, error) {
+	changes := txn.changes
+	txn.changes, txn.tracked = nil, false
+	if beforeCommit != nil {
+		if err := beforeCommit(txn, changes); err != nil {
+			return nil, err
+		}
+	}
+	for _, hook := range txn.hooks.beforeCommit {
+		if err := hook(txn, changes); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+func (txn *Txn) runAfterCommit(changes Changes, commitTs uint64) {
+	for _, hook := range txn.hooks.afterCommit {
+		hook(changes, commitTs)
+	}
+}
+
+func (txn *Txn) afterCommitCallback(changes Changes, commitTs uint64, callback func(error)) func(error) {
+	return func(err error) {
+		if err == nil {
+			txn.runAfterCommit(changes, commitTs)
+		}
+		callback(err)
+	}
 }
 
 //-----------------------------------------------------------------------------
 
-// UpdateWith .
+// Op is the type of a Mutation.
+type Op int
+
+// ops
+const (
+	OpSet Op = iota + 1
+	OpDelete
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpSet:
+		return "set"
+	case OpDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("Op(%d)", int(op))
+}
+
+// Mutation is a write of a transaction, with the fields of its Entry.
+type Mutation struct {
+	Op         Op
+	Key, Value []byte
+	UserMeta   byte
+	ExpiresAt  uint64
+
+	// Discard is set by SetWithDiscard.
+	Discard bool
+
+	// Prev is the value of the key before the transaction (nil if it
+	// did not exist), HasPrev is set if pre-images are enabled
+	// - see DB.EnablePreImages.
+	Prev    []byte
+	HasPrev bool
+}
+
+// Doc returns the value of a set, which is not nil even if nil is set,
+// or nil for a delete.
+func (m Mutation) Doc() []byte {
+	if m.Op == OpDelete {
+		return nil
+	}
+	if m.Value == nil {
+		return []byte{}
+	}
+	return m.Value
+}
+
+// Changes are the mutations of a transaction, in the order they are written.
+type Changes []Mutation
+
+// Latest returns the last mutation of each key, in the order
+// of those last mutations.
+func (c Changes) Latest() Changes {
+	last := make(map[string]int, len(c))
+	for i, m := range c {
+		last[string(m.Key)] = i
+	}
+	if len(last) == len(c) {
+		return c
+	}
+	res := make(Changes, 0, len(last))
+	for i, m := range c {
+		if last[string(m.Key)] == i {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+//-----------------------------------------------------------------------------
+
+// UpdateWith runs fn inside a read-write transaction, and commits it
+// using CommitWith.
 func (db *DB) UpdateWith(fn func(txn *Txn) error, beforeCommit BeforeCommit) error {
 	txn := db.NewTransaction(true)
 	defer txn.Discard()
@@ -266,7 +550,14 @@ func (db *DB) UpdateWith(fn func(txn *Txn) error, beforeCommit BeforeCommit) err
 	return txn.CommitWith(beforeCommit, nil)
 }
 
-// BeforeCommit .
-type BeforeCommit func(*Txn, map[string][]byte) error
+// BeforeCommit is run before commit, with the changes of the transaction.
+type BeforeCommit func(*Txn, Changes) error
+
+// AfterCommit is run after a successful commit, with the committed changes
+// and the commit timestamp. badger does not expose
+// the commit timestamp of a non-managed transaction, so commitTs is only
+// provided for transactions committed at a given timestamp (CommitAt),
+// and it is zero otherwise.
+type AfterCommit func(changes Changes, commitTs uint64)
 
 //-----------------------------------------------------------------------------
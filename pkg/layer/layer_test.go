@@ -64,12 +64,12 @@ func createDB(databaseDir string, deleteExisting bool) *DB {
 func Test01(t *testing.T) {
 	require := require.New(t)
 
-	sampleIndexBuilder := func(txn *Txn, entries map[string][]byte) error {
-		for k, v := range entries {
+	sampleIndexBuilder := func(txn *Txn, changes Changes) error {
+		for _, m := range changes.Latest() {
 			// all indexes must be built here,
-			// based on document type (v), etc, etc.
-			ix := "QQ:" + k
-			if v == nil {
+			// based on document type (m.Value), etc, etc.
+			ix := "QQ:" + string(m.Key)
+			if m.Op == OpDelete {
 				require.NoError(txn.Delete([]byte(ix)))
 			} else {
 				require.NoError(txn.Set([]byte(ix), nil))
@@ -153,12 +153,12 @@ func Test01(t *testing.T) {
 func TestUpdateWith(t *testing.T) {
 	require := require.New(t)
 
-	sampleIndexBuilder := func(txn *Txn, entries map[string][]byte) error {
-		for k, v := range entries {
+	sampleIndexBuilder := func(txn *Txn, changes Changes) error {
+		for _, m := range changes.Latest() {
 			// all indexes must be built here,
-			// based on document type (v), etc, etc.
-			ix := "QQ:" + k
-			if v == nil {
+			// based on document type (m.Value), etc, etc.
+			ix := "QQ:" + string(m.Key)
+			if m.Op == OpDelete {
 				require.NoError(txn.Delete([]byte(ix)))
 			} else {
 				require.NoError(txn.Set([]byte(ix), nil))
@@ -238,12 +238,12 @@ func TestUpdateWith(t *testing.T) {
 }
 
 func BenchmarkOneSimpleSecondaryIndex(b *testing.B) {
-	sampleIndexBuilder := func(txn *Txn, entries map[string][]byte) error {
-		for k, v := range entries {
+	sampleIndexBuilder := func(txn *Txn, changes Changes) error {
+		for _, m := range changes.Latest() {
 			// all indexes must be built here,
-			// based on document type (v), etc, etc.
-			ix := "QQ:" + k
-			if v == nil {
+			// based on document type (m.Value), etc, etc.
+			ix := "QQ:" + string(m.Key)
+			if m.Op == OpDelete {
 				txn.Delete([]byte(ix))
 			} else {
 				txn.Set([]byte(ix), nil)
@@ -357,13 +357,13 @@ func BenchmarkOneSimpleSecondaryIndex(b *testing.B) {
 func BenchmarkTenSimpleSecondaryIndexes(b *testing.B) {
 	b.ReportAllocs()
 
-	sampleIndexBuilder := func(txn *Txn, entries map[string][]byte) error {
-		for k, v := range entries {
+	sampleIndexBuilder := func(txn *Txn, changes Changes) error {
+		for _, m := range changes.Latest() {
 			// all indexes must be built here,
-			// based on document type (v), etc, etc.
+			// based on document type (m.Value), etc, etc.
 			for i := 0; i < 10; i++ {
-				ix := fmt.Sprintf("QQ:%03d"+k, i)
-				if v == nil {
+				ix := fmt.Sprintf("QQ:%03d"+string(m.Key), i)
+				if m.Op == OpDelete {
 					txn.Delete([]byte(ix))
 				} else {
 					txn.Set([]byte(ix), nil)
@@ -474,3 +474,350 @@ func BenchmarkTenSimpleSecondaryIndexes(b *testing.B) {
 		}
 	}()
 }
+
+func TestAddBeforeCommit(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	var calls int64
+	db.AddBeforeCommit(func(txn *Txn, changes Changes) error {
+		atomic.AddInt64(&calls, 1)
+		for _, m := range changes.Latest() {
+			ix := "QQ:" + string(m.Key)
+			if m.Op == OpDelete {
+				if err := txn.Delete([]byte(ix)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := txn.Set([]byte(ix), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	require.NoError(db.Update(func(txn *Txn) error {
+		return txn.Set([]byte("POST:001"), []byte("1"))
+	}))
+	require.NoError(db.UpdateWith(func(txn *Txn) error {
+		return txn.Set([]byte("POST:002"), []byte("2"))
+	}, nil))
+	func() {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.NoError(txn.Set([]byte("POST:003"), []byte("3")))
+		require.NoError(txn.Commit(nil))
+	}()
+	require.Equal(int64(3), atomic.LoadInt64(&calls))
+
+	got := make(map[string]bool)
+	err := db.View(func(txn *Txn) error {
+		itr := txn.NewIterator(DefaultIteratorOptions)
+		defer itr.Close()
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			got[string(itr.Item().Key())] = true
+		}
+		return nil
+	})
+	require.NoError(err)
+	require.Equal(6, len(got))
+	require.True(got["QQ:POST:001"])
+	require.True(got["QQ:POST:002"])
+	require.True(got["QQ:POST:003"])
+}
+
+func TestAddAfterCommit(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	db.AddBeforeCommit(func(txn *Txn, changes Changes) error {
+		for _, m := range changes {
+			if err := txn.Set([]byte("QQ:"+string(m.Key)), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	var (
+		mx        sync.Mutex
+		committed []string
+	)
+	db.AddAfterCommit(func(changes Changes, commitTs uint64) {
+		mx.Lock()
+		defer mx.Unlock()
+		for _, m := range changes {
+			committed = append(committed, fmt.Sprintf("%v %s=%s", m.Op, m.Key, m.Value))
+		}
+	})
+
+	require.NoError(db.Update(func(txn *Txn) error {
+		return txn.Set([]byte("POST:001"), []byte("1"))
+	}))
+	require.Equal([]string{"set POST:001=1"}, committed)
+
+	// failed commits do not run the hooks
+	require.Error(db.Update(func(txn *Txn) error {
+		if err := txn.Set([]byte("POST:002"), []byte("2")); err != nil {
+			return err
+		}
+		return ErrEmptyKey
+	}))
+	require.Equal([]string{"set POST:001=1"}, committed)
+
+	done := make(chan error, 1)
+	txn := db.NewTransaction(true)
+	require.NoError(txn.Delete([]byte("POST:001")))
+	var seen []string
+	require.NoError(txn.Commit(func(err error) {
+		mx.Lock()
+		defer mx.Unlock()
+		seen = append(seen, committed...)
+		done <- err
+	}))
+	require.NoError(<-done)
+	txn.Discard()
+	require.Equal([]string{"set POST:001=1", "delete POST:001="}, seen)
+}
+
+func TestChanges(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	var got Changes
+	db.AddBeforeCommit(func(txn *Txn, changes Changes) error {
+		got = changes
+		return nil
+	})
+
+	require.NoError(db.Update(func(txn *Txn) error {
+		if err := txn.Set([]byte("K:1"), []byte("1")); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("K:2"), nil); err != nil {
+			return err
+		}
+		if err := txn.SetWithMeta([]byte("K:3"), []byte("3"), 7); err != nil {
+			return err
+		}
+		if err := txn.SetWithTTL([]byte("K:4"), []byte("4"), time.Hour); err != nil {
+			return err
+		}
+		return txn.Delete([]byte("K:1"))
+	}))
+
+	require.Equal(5, len(got))
+	require.Equal(OpSet, got[0].Op)
+	require.Equal(OpSet, got[1].Op)
+	require.NotNil(got[1].Doc())
+	require.Equal(byte(7), got[2].UserMeta)
+	require.True(got[3].ExpiresAt > uint64(time.Now().Unix()))
+	require.NoError(db.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("K:4"))
+		if err != nil {
+			return err
+		}
+		require.Equal(item.ExpiresAt(), got[3].ExpiresAt)
+		return nil
+	}))
+	require.Equal(OpDelete, got[4].Op)
+	require.Nil(got[4].Doc())
+
+	var keys []string
+	for _, m := range got.Latest() {
+		keys = append(keys, fmt.Sprintf("%v %s", m.Op, m.Key))
+	}
+	require.Equal([]string{"set K:2", "set K:3", "set K:4", "delete K:1"}, keys)
+}
+
+func TestEnablePreImages(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	var got Changes
+	db.AddBeforeCommit(func(txn *Txn, changes Changes) error {
+		got = changes
+		return txn.Set([]byte("QQ:hook"), nil)
+	})
+
+	require.NoError(db.Update(func(txn *Txn) error {
+		return txn.Set([]byte("K:1"), []byte("1"))
+	}))
+	require.False(got[0].HasPrev)
+
+	db.EnablePreImages()
+	require.NoError(db.Update(func(txn *Txn) error {
+		if err := txn.Set([]byte("K:1"), []byte("2")); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("K:1"), []byte("3")); err != nil {
+			return err
+		}
+		return txn.Set([]byte("K:2"), []byte("1"))
+	}))
+	require.Equal(3, len(got))
+	for _, m := range got {
+		require.True(m.HasPrev)
+	}
+	require.Equal("1", string(got[0].Prev))
+	require.Equal("1", string(got[1].Prev))
+	require.Nil(got[2].Prev)
+}
+
+func TestManagedDB(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "database")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	var opts = DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+	db, err := OpenManaged(opts)
+	require.NoError(err)
+	defer db.Close()
+
+	db.AddBeforeCommit(func(txn *Txn, changes Changes) error {
+		for _, m := range changes.Latest() {
+			ix := "QQ:" + string(m.Key)
+			if m.Op == OpDelete {
+				if err := txn.Delete([]byte(ix)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := txn.Set([]byte(ix), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	var commits []uint64
+	db.AddAfterCommit(func(changes Changes, commitTs uint64) {
+		commits = append(commits, commitTs)
+	})
+
+	require.NoError(db.UpdateAt(1, 2, func(txn *Txn) error {
+		return txn.Set([]byte("POST:001"), []byte("1"))
+	}))
+	require.NoError(db.UpdateAtWith(2, 3, func(txn *Txn) error {
+		return txn.Delete([]byte("POST:001"))
+	}, nil))
+	require.Equal([]uint64{2, 3}, commits)
+
+	exists := func(readTs uint64, key string) (found bool) {
+		require.NoError(db.ViewAt(readTs, func(txn *Txn) error {
+			_, err := txn.Get([]byte(key))
+			found = err == nil
+			return nil
+		}))
+		return
+	}
+	require.False(exists(1, "QQ:POST:001"))
+	require.True(exists(2, "POST:001"))
+	require.True(exists(2, "QQ:POST:001"))
+	require.False(exists(3, "QQ:POST:001"))
+
+	txn := db.NewTransaction(true)
+	require.NoError(txn.Set([]byte("POST:002"), []byte("2")))
+	require.Equal(ErrManagedTxn, txn.Commit(nil))
+	txn.Discard()
+
+	txn = db.NewTransaction(true)
+	require.NoError(txn.Set([]byte("POST:002"), []byte("2")))
+	require.NoError(txn.CommitAt(4, nil))
+	txn.Discard()
+	require.True(exists(4, "QQ:POST:002"))
+
+	_, err = db.GetSequence([]byte("SEQ"), 10)
+	require.Equal(ErrManagedTxn, err)
+}
+
+func TestUpdateRetry(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	var hookCalls int
+	db.AddBeforeCommit(func(txn *Txn, changes Changes) error {
+		hookCalls++
+		for _, m := range changes.Latest() {
+			if err := txn.Set([]byte("QQ:"+string(m.Key)), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// conflicts reads the counter, and until conflicts reaches zero,
+	// another transaction changes the counter before the commit.
+	update := func(opt RetryOptions, conflicts int) (attempts int, err error) {
+		err = db.UpdateRetry(opt, func(txn *Txn) error {
+			attempts++
+			if _, err := txn.Get([]byte("COUNTER")); err != nil && err != ErrKeyNotFound {
+				return err
+			}
+			if conflicts > 0 {
+				conflicts--
+				if err := db.Update(func(other *Txn) error {
+					return other.Set([]byte("COUNTER"), []byte(fmt.Sprint(conflicts)))
+				}); err != nil {
+					return err
+				}
+			}
+			return txn.Set([]byte("POST:001"), []byte("1"))
+		})
+		return
+	}
+
+	var events []RetryEvent
+	opt := RetryOptions{
+		Backoff: time.Millisecond,
+		Jitter:  0.5,
+		OnRetry: func(e RetryEvent) { events = append(events, e) },
+	}
+
+	hookCalls = 0
+	attempts, err := update(opt, 2)
+	require.NoError(err)
+	require.Equal(3, attempts)
+	// 3 attempts and 2 interfering updates
+	require.Equal(5, hookCalls)
+	require.Equal(2, len(events))
+	require.Equal(1, events[0].Attempt)
+	require.Equal(ErrConflict, events[0].Err)
+	require.True(events[0].Backoff <= time.Millisecond)
+	require.Equal(1, len(events[0].Changes))
+	require.Equal("POST:001", string(events[0].Changes[0].Key))
+	require.Equal(RetryStats{Retries: 2}, db.RetryStats())
+
+	require.NoError(db.View(func(txn *Txn) error {
+		_, err := txn.Get([]byte("QQ:POST:001"))
+		return err
+	}))
+
+	opt.Attempts = 2
+	attempts, err = update(opt, 5)
+	require.Equal(ErrConflict, err)
+	require.Equal(2, attempts)
+	require.Equal(RetryStats{Retries: 3, Exhausted: 1}, db.RetryStats())
+
+	// other errors are not retried
+	attempts = 0
+	err = db.UpdateRetry(RetryOptions{}, func(txn *Txn) error {
+		attempts++
+		return ErrEmptyKey
+	})
+	require.Equal(ErrEmptyKey, err)
+	require.Equal(1, attempts)
+}
@@ -0,0 +1,132 @@
+package layer
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// RetryOptions configures retrying updates, zero values are replaced
+// by defaults.
+type RetryOptions struct {
+	// Attempts is the maximum number of attempts, defaults to 5.
+	Attempts int
+
+	// Backoff is the wait before the first retry, which is doubled
+	// after each retry, up to MaxBackoff. Defaults to 10ms and 1s.
+	Backoff, MaxBackoff time.Duration
+
+	// Jitter is the fraction of the backoff (between 0 and 1)
+	// which is randomized.
+	Jitter float64
+
+	// OnRetry is called before waiting for each retry.
+	OnRetry func(RetryEvent)
+}
+
+func (opt *RetryOptions) init() {
+	if opt.Attempts <= 0 {
+		opt.Attempts = 5
+	}
+	if opt.Backoff <= 0 {
+		opt.Backoff = 10 * time.Millisecond
+	}
+	if opt.MaxBackoff <= 0 {
+		opt.MaxBackoff = time.Second
+	}
+	if opt.Jitter < 0 {
+		opt.Jitter = 0
+	}
+	if opt.Jitter > 1 {
+		opt.Jitter = 1
+	}
+}
+
+func (opt *RetryOptions) backoff(attempt int) time.Duration {
+	d := opt.Backoff
+	for i := 1; i < attempt && d < opt.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > opt.MaxBackoff {
+		d = opt.MaxBackoff
+	}
+	if opt.Jitter > 0 {
+		d -= time.Duration(opt.Jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+// RetryEvent describes a failed attempt, which is going to be retried.
+type RetryEvent struct {
+	// Attempt is the number of the failed attempt, starting from 1.
+	Attempt int
+	Err     error
+	Backoff time.Duration
+
+	// Changes are the changes of the failed attempt - written by fn,
+	// before the hooks are run - which helps to find hot keys.
+	Changes Changes
+}
+
+// RetryStats are counters of retrying updates of a DB.
+type RetryStats struct {
+	// Retries is the number of retried attempts.
+	Retries uint64
+	// Exhausted is the number of updates, which failed after all attempts.
+	Exhausted uint64
+}
+
+// RetryStats returns the counters of retrying updates.
+func (db *DB) RetryStats() RetryStats {
+	return RetryStats{
+		Retries:   atomic.LoadUint64(&db.retryStats.Retries),
+		Exhausted: atomic.LoadUint64(&db.retryStats.Exhausted),
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// UpdateRetry is Update, which retries on ErrConflict - see UpdateWithRetry.
+func (db *DB) UpdateRetry(opt RetryOptions, fn func(txn *Txn) error) error {
+	return db.UpdateWithRetry(opt, fn, nil)
+}
+
+// UpdateWithRetry is UpdateWith, which retries on ErrConflict. Each attempt
+// runs fn and the hooks, on a fresh transaction - so fn must not have side
+// effects outside the transaction. Other errors are returned right away.
+func (db *DB) UpdateWithRetry(opt RetryOptions, fn func(txn *Txn) error, beforeCommit BeforeCommit) (reserr error) {
+	opt.init()
+	for attempt := 1; ; attempt++ {
+		var changes Changes
+		reserr = db.UpdateWith(func(txn *Txn) error {
+			if err := fn(txn); err != nil {
+				return err
+			}
+			changes = txn.changes
+			return nil
+		}, beforeCommit)
+		if reserr != ErrConflict {
+			return
+		}
+		if attempt >= opt.Attempts {
+			atomic.AddUint64(&db.retryStats.Exhausted, 1)
+			return
+		}
+
+		atomic.AddUint64(&db.retryStats.Retries, 1)
+		wait := opt.backoff(attempt)
+		if opt.OnRetry != nil {
+			opt.OnRetry(RetryEvent{
+				Attempt: attempt,
+				Err:     reserr,
+				Backoff: wait,
+				Changes: changes,
+			})
+		}
+		time.Sleep(wait)
+	}
+}
+
+//-----------------------------------------------------------------------------
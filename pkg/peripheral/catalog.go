@@ -0,0 +1,276 @@
+package peripheral
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dc0d/positive/pkg/layer"
+)
+
+//-----------------------------------------------------------------------------
+
+// error
+var (
+	ErrIndexBuilding    = fmt.Errorf("index is building")
+	ErrIndexDropping    = fmt.Errorf("index is dropping")
+	ErrIndexNotDefined  = fmt.Errorf("index is not defined")
+	ErrIndexHashChanged = fmt.Errorf("index hash changed")
+)
+
+// IndexState .
+type IndexState string
+
+// index states
+const (
+	// Building indexes are defined, but not emitted for all documents yet.
+	Building IndexState = "building"
+	// Ready indexes are emitted for all documents.
+	Ready IndexState = "ready"
+	// Dropping indexes are being deleted - see DropIndex.
+	Dropping IndexState = "dropping"
+)
+
+// IndexInfo is the stored metadata of an index.
+type IndexInfo struct {
+	Name    string     `json:"name"`
+	Hash    string     `json:"hash"`
+	Version int        `json:"version,omitempty"`
+	State   IndexState `json:"state,omitempty"`
+	Partial bool       `json:"partial,omitempty"`
+	Unique  bool       `json:"unique,omitempty"`
+
+	// Projection are the fields stored by a covering index.
+	Projection []string `json:"projection,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// ReadyAt is the last time the index became ready.
+	ReadyAt time.Time `json:"ready_at"`
+}
+
+// catalog keys are ^#<name>, which do not overlap with index keys ^<hash>.
+const indexCatalog = "#"
+
+func catalogKey(name string) []byte {
+	return []byte(indexSpace + indexCatalog + name)
+}
+
+func infoOf(ix *Index) IndexInfo {
+	return IndexInfo{
+		Name:    ix.name,
+		Hash:    ix.hash,
+		Version: ix.version,
+		Partial: ix.Partial(),
+		Unique:  ix.unique,
+
+		Projection: ix.project,
+	}
+}
+
+// Version sets the version of the index definition, which should be
+// changed when the IndexFn changes - see DefineIndex.
+func Version(version int) IndexOption {
+	return func(ix *Index) { ix.version = version }
+}
+
+//-----------------------------------------------------------------------------
+
+// DefineIndex stores the metadata of ix, so queries can find out
+// about the index - see GetIndexInfo.
+//
+// A new index, or an index with a new version, is stored as Building,
+// since it is not emitted for existing documents - unless there are no
+// documents. Queries refuse Building indexes, until the index is built
+// and marked as Ready - see BuildIndex and SetIndexState.
+//
+// Defining an index fails with ErrHashCollision, if another defined
+// index has the same hash, and with ErrIndexHashChanged if the index is
+// defined with another hash (see ID and LongHash) - the index must be
+// dropped first, so its previous keyspace is deleted (see DropIndex).
+func DefineIndex(db *layer.DB, ix *Index) error {
+	return maintain(db, func(txn *layer.Txn) error {
+		now := time.Now().UTC()
+		info := infoOf(ix)
+		info.UpdatedAt = now
+
+		list, err := ListIndexes(txn)
+		if err != nil {
+			return err
+		}
+		for _, v := range list {
+			if v.Name != ix.name && v.Hash == ix.hash {
+				return fmt.Errorf("%w: %v and %v", ErrHashCollision, v.Name, ix.name)
+			}
+		}
+
+		prev, err := GetIndexInfo(txn, ix.name)
+		switch {
+		case err == nil && prev.Hash != info.Hash:
+			return fmt.Errorf("%w: %v from %v to %v", ErrIndexHashChanged, ix.name, prev.Hash, info.Hash)
+		case err == nil && prev.Version == info.Version:
+			info.State = prev.State
+			info.CreatedAt = prev.CreatedAt
+			info.ReadyAt = prev.ReadyAt
+		case err == nil || err == layer.ErrKeyNotFound:
+			info.CreatedAt = now
+			empty, err := isEmpty(txn)
+			if err != nil {
+				return err
+			}
+			info.State = Building
+			if empty {
+				info.State = Ready
+				info.ReadyAt = now
+			}
+		default:
+			return err
+		}
+
+		return putIndexInfo(txn, &info)
+	})
+}
+
+// SetIndexState changes the state of a defined index,
+// or returns layer.ErrKeyNotFound if the index is not defined.
+func SetIndexState(db *layer.DB, name string, state IndexState) error {
+	return maintain(db, func(txn *layer.Txn) error {
+		return setIndexState(txn, name, state)
+	})
+}
+
+// BuildIndex emits ix for all documents, in batches of batchSize, each batch
+// inside its own transaction, and then marks it as Ready. Documents written
+// meanwhile are indexed by the commit hooks, so ix should be registered
+// (like in a Registry) before. It is safe to run it again after an interruption.
+func BuildIndex(db *layer.DB, batchSize int, ix *Index) error {
+	_, err := batchUpdate(db, nil, batchSize, true, func(txn *layer.Txn, key, val []byte) error {
+		if isReserved(key) {
+			return nil
+		}
+		return Emit(txn, ix, key, document(val))
+	})
+	if err != nil {
+		return err
+	}
+	return SetIndexState(db, ix.name, Ready)
+}
+
+func setIndexState(txn *layer.Txn, name string, state IndexState) error {
+	info, err := GetIndexInfo(txn, name)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if state == Ready && info.State != Ready {
+		info.ReadyAt = now
+	}
+	info.State = state
+	info.UpdatedAt = now
+	return putIndexInfo(txn, info)
+}
+
+// GetIndexInfo returns the stored metadata of the index,
+// or layer.ErrKeyNotFound if the index is not defined.
+func GetIndexInfo(txn *layer.Txn, name string) (*IndexInfo, error) {
+	item, err := txn.Get(catalogKey(name))
+	if err != nil {
+		return nil, err
+	}
+	js, err := item.Value()
+	if err != nil {
+		return nil, err
+	}
+	var info IndexInfo
+	if err := json.Unmarshal(js, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// ListIndexes returns the stored metadata of all defined indexes,
+// ordered by name.
+func ListIndexes(txn *layer.Txn) (list []IndexInfo, reserr error) {
+	prefix := catalogKey("")
+	itr := txn.NewIterator(layer.DefaultIteratorOptions)
+	defer itr.Close()
+	for itr.Seek(prefix); itr.ValidForPrefix(prefix); itr.Next() {
+		js, err := itr.Item().Value()
+		if err != nil {
+			reserr = err
+			return
+		}
+		var info IndexInfo
+		if reserr = json.Unmarshal(js, &info); reserr != nil {
+			return
+		}
+		list = append(list, info)
+	}
+	return
+}
+
+func putIndexInfo(txn *layer.Txn, info *IndexInfo) error {
+	js, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return txn.Set(catalogKey(info.Name), js)
+}
+
+// resolveHash returns the hash of the index with name, from the catalog,
+// and refuses queries on indexes which are not ready. The hash of
+// indexes which are not defined is the hash of their name - indexes with
+// other hashes are not emitted by a Registry, until they are defined.
+func resolveHash(txn *layer.Txn, name string) (string, error) {
+	info, err := GetIndexInfo(txn, name)
+	if err == layer.ErrKeyNotFound {
+		return string(fnvhash([]byte(name))), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	switch info.State {
+	case Building:
+		return "", fmt.Errorf("%w: %v", ErrIndexBuilding, name)
+	case Dropping:
+		return "", fmt.Errorf("%w: %v", ErrIndexDropping, name)
+	}
+	return info.Hash, nil
+}
+
+// checkDefined returns ErrIndexNotDefined, if ix has a hash other than
+// the hash of its name (see ID and LongHash), and it is not defined
+// with that hash - since queries could not find its keyspace.
+func checkDefined(txn *layer.Txn, ix *Index) error {
+	if ix.hash == string(fnvhash([]byte(ix.name))) {
+		return nil
+	}
+	info, err := GetIndexInfo(txn, ix.name)
+	switch {
+	case err == layer.ErrKeyNotFound:
+		return fmt.Errorf("%w: %v", ErrIndexNotDefined, ix.name)
+	case err != nil:
+		return err
+	case info.Hash != ix.hash:
+		return fmt.Errorf("%w: %v from %v to %v", ErrIndexHashChanged, ix.name, info.Hash, ix.hash)
+	}
+	return nil
+}
+
+// isEmpty reports if there are no documents, only reserved keys.
+func isEmpty(txn *layer.Txn) (bool, error) {
+	opt := layer.DefaultIteratorOptions
+	opt.PrefetchValues = false
+	itr := txn.NewIterator(opt)
+	defer itr.Close()
+	for itr.Rewind(); itr.Valid(); {
+		pfx := reservedPrefix(itr.Item().Key())
+		if pfx == nil {
+			return false, nil
+		}
+		itr.Seek(successor(pfx))
+	}
+	return true, nil
+}
+
+//-----------------------------------------------------------------------------
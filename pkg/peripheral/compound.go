@@ -0,0 +1,57 @@
+package peripheral
+
+import (
+	"github.com/dc0d/positive/pkg/peripheral/keyenc"
+)
+
+//-----------------------------------------------------------------------------
+
+func (e IndexEntry) index() ([]byte, error) {
+	if len(e.Fields) == 0 {
+		return e.Index, nil
+	}
+	return keyenc.Tuple(e.Fields...)
+}
+
+func (q *Q) isCompound() bool {
+	return len(q.Eq) > 0 || q.From != nil || q.To != nil
+}
+
+// compound sets Start, End and Prefix, based on Eq, From and To.
+func (q *Q) compound() (reserr error) {
+	q.Prefix, reserr = keyenc.Tuple(q.Eq...)
+	if reserr != nil {
+		return
+	}
+	if q.Reverse {
+		// bounds are swapped, the iteration starts from To (exclusive)
+		// and stops at From (inclusive).
+		q.Start, q.End = nil, nil
+		if q.To != nil {
+			q.Start, reserr = keyenc.Tuple(append(q.Eq[:len(q.Eq):len(q.Eq)], q.To)...)
+			if reserr != nil {
+				return
+			}
+		}
+		if q.From != nil {
+			q.End, reserr = keyenc.Tuple(append(q.Eq[:len(q.Eq):len(q.Eq)], q.From)...)
+		}
+		return
+	}
+	q.Start, q.End = q.Prefix, nil
+	if q.From != nil {
+		q.Start, reserr = keyenc.Tuple(append(q.Eq[:len(q.Eq):len(q.Eq)], q.From)...)
+		if reserr != nil {
+			return
+		}
+	}
+	if q.To != nil {
+		q.End, reserr = keyenc.Tuple(append(q.Eq[:len(q.Eq):len(q.Eq)], q.To)...)
+		if reserr != nil {
+			return
+		}
+	}
+	return
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,34 @@
+package peripheral
+
+import (
+	"encoding/json"
+)
+
+//-----------------------------------------------------------------------------
+
+// Project makes the index a covering index, which stores the provided
+// fields of the JSON document, in the value of each index entry
+// (unless the IndexFn provides IndexEntry.Val). The projection can be read
+// using Res.Projection, without loading the document.
+func Project(fields ...string) IndexOption {
+	return func(ix *Index) { ix.project = fields }
+}
+
+// Projection decodes the stored projection of a covering index into v.
+func (rs Res) Projection(v interface{}) error { return json.Unmarshal(rs.Val, v) }
+
+func project(doc []byte, fields []string) ([]byte, error) {
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &all); err != nil {
+		return nil, err
+	}
+	res := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		if v, ok := all[f]; ok {
+			res[f] = v
+		}
+	}
+	return json.Marshal(res)
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,98 @@
+package peripheral
+
+import (
+	"github.com/dc0d/positive/pkg/layer"
+)
+
+//-----------------------------------------------------------------------------
+
+// dropBatchSize is the maximum number of keys deleted in one transaction,
+// a transaction is committed earlier if it gets too big.
+const dropBatchSize = 1000
+
+// DropIndex deletes all keys of the index with name - and its stored
+// metadata, in bounded-size transactions. A defined index is marked
+// as Dropping first, so queries refuse it. progress functions are called
+// with the number of deleted keys so far, after each transaction.
+// It is safe to call it again after an interruption,
+// and dropping an index which does not exist is a no-op.
+//
+// The index should be unregistered before it is dropped, otherwise
+// concurrent writes would keep on emitting it.
+func DropIndex(db *layer.DB, name string, progress ...func(deleted int)) error {
+	if name == "" {
+		return ErrNoIndexNameProvided
+	}
+
+	hash := string(fnvhash([]byte(name)))
+	err := maintain(db, func(txn *layer.Txn) error {
+		info, err := GetIndexInfo(txn, name)
+		if err == layer.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		hash = info.Hash
+		return setIndexState(txn, name, Dropping)
+	})
+	if err != nil {
+		return err
+	}
+
+	// only the index domains, keys like ^<hash>user are documents
+	deleted := 0
+	for _, domain := range []string{indexK2X, indexX2K, indexUnique} {
+		prefix := space(hash, domain)
+		for {
+			n, err := dropBatch(db, prefix)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			deleted += n
+			for _, fn := range progress {
+				fn(deleted)
+			}
+		}
+	}
+
+	return maintain(db, func(txn *layer.Txn) error {
+		return txn.Delete(catalogKey(name))
+	})
+}
+
+// dropBatch deletes up to dropBatchSize keys with prefix, inside one
+// transaction, and returns the number of deleted keys.
+func dropBatch(db *layer.DB, prefix []byte) (deleted int, reserr error) {
+	reserr = maintain(db, func(txn *layer.Txn) error {
+		opt := layer.DefaultIteratorOptions
+		opt.PrefetchValues = false
+		itr := txn.NewIterator(opt)
+		var keys [][]byte
+		for itr.Seek(prefix); itr.ValidForPrefix(prefix) && len(keys) < dropBatchSize; itr.Next() {
+			keys = append(keys, itr.Item().KeyCopy(nil))
+		}
+		itr.Close()
+
+		for _, k := range keys {
+			err := txn.Delete(k)
+			if err == layer.ErrTxnTooBig {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	if reserr != nil {
+		deleted = 0
+	}
+	return
+}
+
+//-----------------------------------------------------------------------------
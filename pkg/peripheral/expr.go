@@ -0,0 +1,500 @@
+package peripheral
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/dc0d/positive/pkg/layer"
+)
+
+//-----------------------------------------------------------------------------
+
+// error
+var (
+	ErrUnboundedNot = fmt.Errorf("negation must be combined with a positive expression")
+	ErrEmptyExpr    = fmt.Errorf("empty expression")
+)
+
+// Expr is a boolean expression over indexes, which is evaluated
+// to a stream of sorted primary keys - see Find and FindFunc.
+type Expr interface {
+	cursor(txn *layer.Txn) (keyCursor, error)
+}
+
+// Match selects the keys of the results of the query.
+func Match(q Q) Expr { return matchExpr{q: q} }
+
+// And selects the keys selected by all exprs. Not expressions
+// inside And are subtracted from the result.
+func And(exprs ...Expr) Expr { return andExpr(exprs) }
+
+// Or selects the keys selected by any of exprs.
+func Or(exprs ...Expr) Expr { return orExpr(exprs) }
+
+// Not excludes the keys selected by expr, it can only be used inside And.
+func Not(expr Expr) Expr { return notExpr{expr: expr} }
+
+// Find evaluates expr and returns the selected primary keys, sorted.
+func Find(txn *layer.Txn, expr Expr) (keys [][]byte, reserr error) {
+	reserr = FindFunc(txn, expr, func(key []byte) (bool, error) {
+		keys = append(keys, key)
+		return false, nil
+	})
+	if reserr != nil {
+		keys = nil
+	}
+	return
+}
+
+// FindFunc evaluates expr and streams the selected primary keys to fn,
+// sorted, until fn returns stop or an error, or the keys are exhausted.
+//
+// Each Match is read using a key-only iteration. The keys of a Match for
+// a single index value are sorted, so they are streamed in batches, and
+// combined using merge joins - other Matches (like ranges) are read at once,
+// and sorted. No iterator is left open while fn is called.
+func FindFunc(txn *layer.Txn, expr Expr, fn func(key []byte) (stop bool, err error)) error {
+	if expr == nil {
+		return ErrEmptyExpr
+	}
+	c, err := expr.cursor(txn)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	for {
+		key, err := c.next()
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			return nil
+		}
+		stop, err := fn(key)
+		if err != nil {
+			return err
+		}
+		if stop {
+			return nil
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// keyCursor streams sorted unique keys, next returns nil
+// when the keys are exhausted.
+type keyCursor interface {
+	next() ([]byte, error)
+	close()
+}
+
+func closeAll(cursors []keyCursor) {
+	for _, c := range cursors {
+		c.close()
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+type matchExpr struct{ q Q }
+
+func (m matchExpr) cursor(txn *layer.Txn) (keyCursor, error) {
+	q, err := newQuery(txn, m.q)
+	if err != nil {
+		return nil, err
+	}
+	if !m.q.Reverse {
+		c, single, err := newMatchCursor(txn, q)
+		if err != nil {
+			return nil, err
+		}
+		if single {
+			return c, nil
+		}
+	}
+
+	var (
+		set  keySet
+		skip = m.q.Skip
+	)
+	err = q.iterate(txn, true, func(item *layer.Item) (bool, error) {
+		if skip > 0 {
+			skip--
+			return false, nil
+		}
+		rs, err := q.decode(item.Key())
+		if err != nil {
+			return false, err
+		}
+		set = append(set, rs.Key)
+		return m.q.Limit > 0 && len(set) >= m.q.Limit, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &setCursor{set: set.normalize()}, nil
+}
+
+// matchBatchSize is the number of keys a matchCursor reads at once.
+const matchBatchSize = 100
+
+// matchCursor streams the keys of a query, which are sorted if they all
+// have the same index value. Keys are read in batches, each with its own
+// iterator, since only one iterator can be open in a transaction.
+type matchCursor struct {
+	txn     *layer.Txn
+	q       *query
+	buf     [][]byte
+	seek    []byte
+	done    bool
+	skip, n int
+}
+
+// newMatchCursor creates a cursor for q, and reports if all results
+// of q have the same index value, by seeking past the first one.
+func newMatchCursor(txn *layer.Txn, q *query) (c *matchCursor, single bool, reserr error) {
+	c = &matchCursor{txn: txn, q: q, skip: q.params.Skip}
+	itr := c.open()
+	defer itr.Close()
+	if !c.valid(itr) {
+		return c, true, nil
+	}
+	index, _, err := splitIndexKey(itr.Item().Key(), q.hash, q.domain)
+	if err != nil {
+		reserr = err
+		return
+	}
+	itr.Seek(successor(appendSegment(space(q.hash, q.domain), index)))
+	single = !c.valid(itr)
+	return
+}
+
+// open returns an iterator, positioned where the cursor stopped.
+func (c *matchCursor) open() *layer.Iterator {
+	opt := layer.DefaultIteratorOptions
+	opt.PrefetchValues = false
+	opt.PrefetchSize = matchBatchSize
+	itr := c.txn.NewIterator(opt)
+	if c.seek != nil {
+		itr.Seek(c.seek)
+		return itr
+	}
+	itr.Seek(c.q.start)
+	if len(c.q.params.After) > 0 && itr.Valid() && bytes.Equal(itr.Item().Key(), c.q.start) {
+		itr.Next()
+	}
+	return itr
+}
+
+func (c *matchCursor) valid(itr *layer.Iterator) bool {
+	if !itr.ValidForPrefix(c.q.prefix) {
+		return false
+	}
+	return len(c.q.end) == 0 || bytes.Compare(itr.Item().Key(), c.q.end) <= 0
+}
+
+// fill reads the next batch of keys.
+func (c *matchCursor) fill() error {
+	itr := c.open()
+	defer itr.Close()
+	limit := c.q.params.Limit
+	for ; c.valid(itr); itr.Next() {
+		if len(c.buf) >= matchBatchSize {
+			c.seek = itr.Item().KeyCopy(nil)
+			return nil
+		}
+		if limit > 0 && c.n >= limit {
+			break
+		}
+		if c.skip > 0 {
+			c.skip--
+			continue
+		}
+		rs, err := c.q.decode(itr.Item().Key())
+		if err != nil {
+			return err
+		}
+		c.buf = append(c.buf, rs.Key)
+		c.n++
+	}
+	c.done = true
+	return nil
+}
+
+func (c *matchCursor) next() ([]byte, error) {
+	if len(c.buf) == 0 {
+		if c.done {
+			return nil, nil
+		}
+		if err := c.fill(); err != nil {
+			return nil, err
+		}
+		if len(c.buf) == 0 {
+			return nil, nil
+		}
+	}
+	key := c.buf[0]
+	c.buf = c.buf[1:]
+	return key, nil
+}
+
+func (c *matchCursor) close() {}
+
+// setCursor streams the keys of a keySet.
+type setCursor struct{ set keySet }
+
+func (c *setCursor) next() ([]byte, error) {
+	if len(c.set) == 0 {
+		return nil, nil
+	}
+	key := c.set[0]
+	c.set = c.set[1:]
+	return key, nil
+}
+
+func (*setCursor) close() {}
+
+//-----------------------------------------------------------------------------
+
+type andExpr []Expr
+
+func (a andExpr) cursor(txn *layer.Txn) (_ keyCursor, reserr error) {
+	var positive, negative []keyCursor
+	defer func() {
+		if reserr != nil {
+			closeAll(positive)
+			closeAll(negative)
+		}
+	}()
+	for _, expr := range a {
+		not, isNot := expr.(notExpr)
+		if isNot {
+			expr = not.expr
+		}
+		if expr == nil {
+			return nil, ErrEmptyExpr
+		}
+		c, err := expr.cursor(txn)
+		if err != nil {
+			return nil, err
+		}
+		if isNot {
+			negative = append(negative, newPeekCursor(c))
+			continue
+		}
+		positive = append(positive, c)
+	}
+	if len(positive) == 0 {
+		return nil, ErrUnboundedNot
+	}
+	return &andCursor{positive: positive, negative: negative}, nil
+}
+
+// andCursor is a merge join of positive cursors, which skips
+// the keys of negative cursors.
+type andCursor struct {
+	positive, negative []keyCursor
+	done               bool
+}
+
+func (c *andCursor) next() ([]byte, error) {
+	for !c.done {
+		key, err := c.intersect()
+		if err != nil || key == nil {
+			c.done = true
+			return nil, err
+		}
+		excluded, err := c.excluded(key)
+		if err != nil {
+			return nil, err
+		}
+		if !excluded {
+			return key, nil
+		}
+	}
+	return nil, nil
+}
+
+// intersect advances positive cursors to their next common key.
+func (c *andCursor) intersect() ([]byte, error) {
+	keys := make([][]byte, len(c.positive))
+	var max []byte
+	for i, p := range c.positive {
+		key, err := p.next()
+		if err != nil || key == nil {
+			return nil, err
+		}
+		keys[i] = key
+		if bytes.Compare(key, max) > 0 {
+			max = key
+		}
+	}
+	for {
+		aligned := true
+		for i, p := range c.positive {
+			for bytes.Compare(keys[i], max) < 0 {
+				key, err := p.next()
+				if err != nil || key == nil {
+					return nil, err
+				}
+				keys[i] = key
+			}
+			if bytes.Compare(keys[i], max) > 0 {
+				max = keys[i]
+				aligned = false
+			}
+		}
+		if aligned {
+			return max, nil
+		}
+	}
+}
+
+func (c *andCursor) excluded(key []byte) (bool, error) {
+	for _, n := range c.negative {
+		found, err := n.(*peekCursor).skipTo(key)
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+func (c *andCursor) close() {
+	closeAll(c.positive)
+	closeAll(c.negative)
+}
+
+//-----------------------------------------------------------------------------
+
+type orExpr []Expr
+
+func (o orExpr) cursor(txn *layer.Txn) (_ keyCursor, reserr error) {
+	if len(o) == 0 {
+		return nil, ErrEmptyExpr
+	}
+	var cursors []*peekCursor
+	defer func() {
+		if reserr != nil {
+			for _, c := range cursors {
+				c.close()
+			}
+		}
+	}()
+	for _, expr := range o {
+		if expr == nil {
+			return nil, ErrEmptyExpr
+		}
+		c, err := expr.cursor(txn)
+		if err != nil {
+			return nil, err
+		}
+		cursors = append(cursors, newPeekCursor(c))
+	}
+	return &orCursor{cursors: cursors}, nil
+}
+
+// orCursor is a merge of cursors, without duplicates.
+type orCursor struct{ cursors []*peekCursor }
+
+func (c *orCursor) next() ([]byte, error) {
+	var min []byte
+	for _, p := range c.cursors {
+		key, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if key != nil && (min == nil || bytes.Compare(key, min) < 0) {
+			min = key
+		}
+	}
+	if min == nil {
+		return nil, nil
+	}
+	for _, p := range c.cursors {
+		if key, _ := p.peek(); key != nil && bytes.Equal(key, min) {
+			p.head = nil
+		}
+	}
+	return min, nil
+}
+
+func (c *orCursor) close() {
+	for _, p := range c.cursors {
+		p.close()
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+type notExpr struct{ expr Expr }
+
+func (notExpr) cursor(*layer.Txn) (keyCursor, error) { return nil, ErrUnboundedNot }
+
+//-----------------------------------------------------------------------------
+
+// peekCursor buffers the next key of a cursor.
+type peekCursor struct {
+	keyCursor
+	head []byte
+	done bool
+}
+
+func newPeekCursor(c keyCursor) *peekCursor { return &peekCursor{keyCursor: c} }
+
+func (p *peekCursor) peek() ([]byte, error) {
+	if p.head != nil || p.done {
+		return p.head, nil
+	}
+	key, err := p.keyCursor.next()
+	if err != nil {
+		return nil, err
+	}
+	p.head, p.done = key, key == nil
+	return key, nil
+}
+
+func (p *peekCursor) next() ([]byte, error) {
+	key, err := p.peek()
+	p.head = nil
+	return key, err
+}
+
+// skipTo advances the cursor to the first key not less than key,
+// and reports if it is key.
+func (p *peekCursor) skipTo(key []byte) (bool, error) {
+	for {
+		head, err := p.peek()
+		if err != nil || head == nil {
+			return false, err
+		}
+		switch cmp := bytes.Compare(head, key); {
+		case cmp == 0:
+			return true, nil
+		case cmp > 0:
+			return false, nil
+		}
+		p.head = nil
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// keySet is a sorted list of unique keys.
+type keySet [][]byte
+
+func (s keySet) normalize() keySet {
+	sort.Slice(s, func(i, j int) bool { return bytes.Compare(s[i], s[j]) < 0 })
+	var res keySet
+	for _, k := range s {
+		if n := len(res); n > 0 && bytes.Equal(res[n-1], k) {
+			continue
+		}
+		res = append(res, k)
+	}
+	return res
+}
+
+//-----------------------------------------------------------------------------
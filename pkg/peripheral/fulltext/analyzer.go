@@ -0,0 +1,94 @@
+package fulltext
+
+import (
+	"strings"
+	"unicode"
+)
+
+//-----------------------------------------------------------------------------
+
+// Token is an analyzed term, and its position in the original text.
+type Token struct {
+	Term string
+	Pos  int
+}
+
+// Analyzer turns a text into tokens: it splits the text into words
+// (sequences of letters and digits), lowercases them, drops stop words
+// and stems the rest.
+type Analyzer struct {
+	StopWords map[string]bool
+	Stem      func(string) string
+}
+
+// NewAnalyzer creates an Analyzer with english stop words and
+// a simple suffix stripping stemmer.
+func NewAnalyzer() *Analyzer {
+	stopWords := make(map[string]bool)
+	for _, v := range strings.Fields(englishStopWords) {
+		stopWords[v] = true
+	}
+	return &Analyzer{StopWords: stopWords, Stem: Stem}
+}
+
+// Analyze .
+func (a *Analyzer) Analyze(text string) (tokens []Token) {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for pos, w := range words {
+		w = strings.ToLower(w)
+		if a.StopWords[w] {
+			continue
+		}
+		if a.Stem != nil {
+			w = a.Stem(w)
+		}
+		if w == "" {
+			continue
+		}
+		tokens = append(tokens, Token{Term: w, Pos: pos})
+	}
+	return
+}
+
+//-----------------------------------------------------------------------------
+
+var suffixes = []struct{ suffix, replacement string }{
+	{"ational", "ate"},
+	{"ization", "ize"},
+	{"fulness", "ful"},
+	{"iveness", "ive"},
+	{"ingly", ""},
+	{"edly", ""},
+	{"ies", "y"},
+	{"ing", ""},
+	{"ed", ""},
+	{"ly", ""},
+	{"es", ""},
+	{"s", ""},
+}
+
+// Stem strips common english suffixes, keeping at least three letters.
+func Stem(word string) string {
+	for _, v := range suffixes {
+		if !strings.HasSuffix(word, v.suffix) {
+			continue
+		}
+		stem := word[:len(word)-len(v.suffix)]
+		if len(stem) < 3 {
+			continue
+		}
+		if v.suffix == "s" && strings.HasSuffix(stem, "s") {
+			// like class
+			return word
+		}
+		return stem + v.replacement
+	}
+	return word
+}
+
+const englishStopWords = `a an and are as at be but by for if in into is it
+no not of on or such that the their then there these they this to was will with`
+
+//-----------------------------------------------------------------------------
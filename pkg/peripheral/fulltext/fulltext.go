@@ -0,0 +1,306 @@
+// Package fulltext provides a full-text search index on top of peripheral,
+// with an analyzer pipeline and BM25 ranking.
+package fulltext
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/dc0d/positive/pkg/layer"
+	"github.com/dc0d/positive/pkg/peripheral"
+)
+
+//-----------------------------------------------------------------------------
+
+// error
+var (
+	ErrInvalidPosting = fmt.Errorf("invalid posting")
+)
+
+// BM25 parameters
+const (
+	k1 = 1.2
+	b  = 0.75
+)
+
+// TextFn extracts the text of a document.
+type TextFn func(key, val []byte) (string, error)
+
+// Index is a full-text index. Postings are emitted as a peripheral index,
+// so the underlying index (see Index.Index) must be maintained like
+// any other index - for example by registering it in a peripheral.Registry.
+//
+// Each term of a document is emitted with the term as index value,
+// and the document length and term positions as its value.
+// Each document also has an entry with an empty term, holding
+// the document length, which is used for ranking.
+type Index struct {
+	index    *peripheral.Index
+	analyzer *Analyzer
+}
+
+// NewIndex creates a full-text index. If analyzer is nil,
+// NewAnalyzer is used.
+func NewIndex(name string, textFn TextFn, analyzer *Analyzer, opts ...peripheral.IndexOption) *Index {
+	if textFn == nil {
+		panic("textFn must be provided")
+	}
+	if analyzer == nil {
+		analyzer = NewAnalyzer()
+	}
+	res := &Index{analyzer: analyzer}
+	res.index = peripheral.NewIndex(name, func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		text, err := textFn(key, val)
+		if err != nil {
+			return nil, err
+		}
+		tokens := analyzer.Analyze(text)
+		if len(tokens) == 0 {
+			return
+		}
+		dl := len(tokens)
+		positions := make(map[string][]int)
+		var terms []string
+		for _, t := range tokens {
+			if _, ok := positions[t.Term]; !ok {
+				terms = append(terms, t.Term)
+			}
+			positions[t.Term] = append(positions[t.Term], t.Pos)
+		}
+		entries = append(entries, peripheral.IndexEntry{Fields: []interface{}{"", int64(dl)}})
+		for _, term := range terms {
+			entries = append(entries, peripheral.IndexEntry{
+				Fields: []interface{}{term},
+				Val:    encodePosting(dl, positions[term]),
+			})
+		}
+		return
+	}, opts...)
+	return res
+}
+
+// Index returns the underlying peripheral index.
+func (ix *Index) Index() *peripheral.Index { return ix.index }
+
+//-----------------------------------------------------------------------------
+
+// Query .
+type Query struct {
+	Text string
+	// Phrase only matches documents, containing the terms of Text
+	// next to each other, in the same order.
+	Phrase bool
+	// Limit is the maximum number of hits, all hits are returned if not provided.
+	Limit int
+	// Stats are used for ranking, instead of calculating them for each
+	// search - see Index.Stats.
+	Stats *Stats
+}
+
+// Stats are the statistics of the indexed documents, used for ranking.
+type Stats struct {
+	// Docs is the number of documents.
+	Docs int
+	// Length is the total length (number of tokens) of documents.
+	Length int64
+}
+
+func (s Stats) avgdl() float64 {
+	if s.Docs == 0 {
+		return 0
+	}
+	return float64(s.Length) / float64(s.Docs)
+}
+
+// Hit .
+type Hit struct {
+	Key   []byte
+	Score float64
+}
+
+// Search returns the documents matching any of the terms of q.Text
+// (or the phrase), ranked by BM25.
+func (ix *Index) Search(txn *layer.Txn, q Query) (hits []Hit, reserr error) {
+	tokens := ix.analyzer.Analyze(q.Text)
+	if len(tokens) == 0 {
+		return
+	}
+
+	var terms []string
+	postings := make(map[string]map[string]posting)
+	for _, t := range tokens {
+		if _, ok := postings[t.Term]; ok {
+			continue
+		}
+		terms = append(terms, t.Term)
+		ps, err := ix.postings(txn, t.Term)
+		if err != nil {
+			reserr = err
+			return
+		}
+		postings[t.Term] = ps
+	}
+
+	candidates := make(map[string]bool)
+	for _, term := range terms {
+		for k := range postings[term] {
+			candidates[k] = true
+		}
+	}
+	if q.Phrase {
+		for k := range candidates {
+			if !matchPhrase(k, tokens, postings) {
+				delete(candidates, k)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	stats := q.Stats
+	if stats == nil {
+		s, err := ix.Stats(txn)
+		if err != nil {
+			reserr = err
+			return
+		}
+		stats = &s
+	}
+	n, avgdl := float64(stats.Docs), stats.avgdl()
+
+	for k := range candidates {
+		var score float64
+		for _, term := range terms {
+			p, ok := postings[term][k]
+			if !ok {
+				continue
+			}
+			df := float64(len(postings[term]))
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			tf := float64(len(p.positions))
+			score += idf * tf * (k1 + 1) / (tf + k1*(1-b+b*float64(p.dl)/avgdl))
+		}
+		hits = append(hits, Hit{Key: []byte(k), Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return bytes.Compare(hits[i].Key, hits[j].Key) < 0
+	})
+	if q.Limit > 0 && len(hits) > q.Limit {
+		hits = hits[:q.Limit]
+	}
+	return
+}
+
+func matchPhrase(key string, tokens []Token, postings map[string]map[string]posting) bool {
+	first, ok := postings[tokens[0].Term][key]
+	if !ok {
+		return false
+	}
+	for _, start := range first.positions {
+		found := true
+		for _, t := range tokens[1:] {
+			p, ok := postings[t.Term][key]
+			if !ok || !p.has(start+t.Pos-tokens[0].Pos) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func (ix *Index) postings(txn *layer.Txn, term string) (map[string]posting, error) {
+	res := make(map[string]posting)
+	err := peripheral.Scan(txn, peripheral.Q{Index: ix.index.Name(), Eq: []interface{}{term}}, func(rs peripheral.Res) (bool, error) {
+		p, err := decodePosting(rs.Val)
+		if err != nil {
+			return false, err
+		}
+		res[string(rs.Key)] = p
+		return false, nil
+	})
+	return res, err
+}
+
+// Stats walks the document length entries of the index, so its cost grows
+// with the number of documents - and it is calculated by each Search,
+// unless it is passed as Query.Stats. Since ranking does not need exact
+// statistics, callers can calculate it once, and refresh it periodically.
+func (ix *Index) Stats(txn *layer.Txn) (stats Stats, reserr error) {
+	reserr = peripheral.Scan(txn, peripheral.Q{Index: ix.index.Name(), Eq: []interface{}{""}}, func(rs peripheral.Res) (bool, error) {
+		if len(rs.Fields) != 2 {
+			return false, ErrInvalidPosting
+		}
+		dl, ok := rs.Fields[1].(int64)
+		if !ok {
+			return false, ErrInvalidPosting
+		}
+		stats.Docs++
+		stats.Length += dl
+		return false, nil
+	})
+	return
+}
+
+//-----------------------------------------------------------------------------
+
+type posting struct {
+	dl        int
+	positions []int
+}
+
+func (p posting) has(pos int) bool {
+	i := sort.SearchInts(p.positions, pos)
+	return i < len(p.positions) && p.positions[i] == pos
+}
+
+// encodePosting encodes the document length, and the delta
+// encoded positions, as uvarints.
+func encodePosting(dl int, positions []int) []byte {
+	buf := make([]byte, 0, (len(positions)+2)*2)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	put := func(v int) {
+		n := binary.PutUvarint(tmp, uint64(v))
+		buf = append(buf, tmp[:n]...)
+	}
+	put(dl)
+	put(len(positions))
+	last := 0
+	for _, p := range positions {
+		put(p - last)
+		last = p
+	}
+	return buf
+}
+
+func decodePosting(b []byte) (p posting, reserr error) {
+	read := func() int {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			reserr = ErrInvalidPosting
+			return 0
+		}
+		b = b[n:]
+		return int(v)
+	}
+	p.dl = read()
+	cnt := read()
+	last := 0
+	for i := 0; i < cnt && reserr == nil; i++ {
+		last += read()
+		p.positions = append(p.positions, last)
+	}
+	return
+}
+
+//-----------------------------------------------------------------------------
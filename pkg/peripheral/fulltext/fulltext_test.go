@@ -0,0 +1,167 @@
+package fulltext_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dc0d/positive/pkg/layer"
+	"github.com/dc0d/positive/pkg/peripheral"
+	"github.com/dc0d/positive/pkg/peripheral/fulltext"
+	"github.com/stretchr/testify/require"
+)
+
+func mkdir(d string) {
+	if err := os.MkdirAll(d, 0777); err != nil {
+		if !os.IsExist(err) {
+			panic(err)
+		}
+	}
+}
+
+func createDB(databaseDir string, deleteExisting bool) *layer.DB {
+	if databaseDir == "" {
+		databaseDir, _ = ioutil.TempDir(os.TempDir(), "database")
+	} else {
+		databaseDir = filepath.Join(os.TempDir(), databaseDir)
+	}
+	mkdir(databaseDir)
+
+	if deleteExisting {
+		stat, err := os.Stat(databaseDir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				panic(err)
+			}
+		}
+		if stat != nil {
+			if err := os.RemoveAll(databaseDir); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	index := filepath.Join(databaseDir, "index")
+	data := filepath.Join(databaseDir, "data")
+
+	mkdir(index)
+	mkdir(data)
+
+	var opts = layer.DefaultOptions
+	opts.Dir = index
+	opts.ValueDir = data
+	preppedDB, err := layer.Open(opts)
+	if err != nil {
+		panic(err)
+	}
+
+	return preppedDB
+}
+
+func TestAnalyze(t *testing.T) {
+	require := require.New(t)
+
+	a := fulltext.NewAnalyzer()
+	tokens := a.Analyze("The Lord of the Rings, walking-stories!")
+	require.Equal([]fulltext.Token{
+		{Term: "lord", Pos: 1},
+		{Term: "ring", Pos: 4},
+		{Term: "walk", Pos: 5},
+		{Term: "story", Pos: 6},
+	}, tokens)
+
+	require.Equal("class", fulltext.Stem("class"))
+	require.Equal("relate", fulltext.Stem("relational"))
+	require.Equal("is", fulltext.Stem("is"))
+}
+
+func TestSearch(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	ix := fulltext.NewIndex("text", func(key, val []byte) (string, error) {
+		return string(val), nil
+	}, nil)
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(ix.Index()))
+	registry.Attach(db)
+
+	docs := map[string]string{
+		"DOC:1": "the lord of the rings",
+		"DOC:2": "rings of power, rings of fire, rings everywhere",
+		"DOC:3": "a short story about a lord",
+		"DOC:4": "nothing relevant here",
+	}
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		for k, v := range docs {
+			if err := txn.Set([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	keys := func(hits []fulltext.Hit) (res []string) {
+		for _, h := range hits {
+			res = append(res, string(h.Key))
+		}
+		return
+	}
+
+	require.NoError(db.View(func(txn *layer.Txn) error {
+		hits, err := ix.Search(txn, fulltext.Query{Text: "ring"})
+		require.NoError(err)
+		require.Equal([]string{"DOC:2", "DOC:1"}, keys(hits))
+		require.True(hits[0].Score > hits[1].Score)
+
+		hits, err = ix.Search(txn, fulltext.Query{Text: "lord rings"})
+		require.NoError(err)
+		require.Equal([]string{"DOC:1", "DOC:2", "DOC:3"}, keys(hits))
+
+		hits, err = ix.Search(txn, fulltext.Query{Text: "lord rings", Limit: 1})
+		require.NoError(err)
+		require.Equal([]string{"DOC:1"}, keys(hits))
+
+		hits, err = ix.Search(txn, fulltext.Query{Text: "Lord of the Rings", Phrase: true})
+		require.NoError(err)
+		require.Equal([]string{"DOC:1"}, keys(hits))
+
+		hits, err = ix.Search(txn, fulltext.Query{Text: "rings lord", Phrase: true})
+		require.NoError(err)
+		require.Empty(hits)
+
+		hits, err = ix.Search(txn, fulltext.Query{Text: "the"})
+		require.NoError(err)
+		require.Empty(hits)
+
+		stats, err := ix.Stats(txn)
+		require.NoError(err)
+		require.Equal(4, stats.Docs)
+		require.True(stats.Length > 0)
+
+		hits, err = ix.Search(txn, fulltext.Query{Text: "lord rings"})
+		require.NoError(err)
+		cached, err := ix.Search(txn, fulltext.Query{Text: "lord rings", Stats: &stats})
+		require.NoError(err)
+		require.Equal(hits, cached)
+		return nil
+	}))
+
+	// updates and deletes replace the postings
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		if err := txn.Set([]byte("DOC:4"), []byte("rings again")); err != nil {
+			return err
+		}
+		return txn.Delete([]byte("DOC:2"))
+	}))
+
+	require.NoError(db.View(func(txn *layer.Txn) error {
+		hits, err := ix.Search(txn, fulltext.Query{Text: "rings"})
+		require.NoError(err)
+		require.ElementsMatch([]string{"DOC:1", "DOC:4"}, keys(hits))
+		return nil
+	}))
+}
@@ -0,0 +1,332 @@
+// Package geo provides a geospatial index on top of peripheral,
+// for proximity and bounding-box queries.
+//
+// Points are encoded as cells of a z-order curve (like a geohash), so points
+// close to each other are likely to have close index values. A query expands
+// the region into the cells covering it, scans the index value range of each
+// cell, and filters the points by their exact location.
+package geo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/dc0d/positive/pkg/layer"
+	"github.com/dc0d/positive/pkg/peripheral"
+)
+
+//-----------------------------------------------------------------------------
+
+// error
+var (
+	ErrInvalidPoint = fmt.Errorf("invalid point")
+	ErrInvalidBox   = fmt.Errorf("invalid box")
+)
+
+const (
+	// maxLevel is the number of bits per axis.
+	maxLevel = 26
+
+	// EarthRadius in meters.
+	EarthRadius = 6371008.8
+)
+
+// Point .
+type Point struct {
+	Lat, Lng float64
+}
+
+func (p Point) valid() bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lng >= -180 && p.Lng <= 180
+}
+
+// Box is a bounding box, from the south-west corner Min,
+// to the north-east corner Max. If Min.Lng is greater than Max.Lng,
+// the box crosses the antimeridian.
+type Box struct {
+	Min, Max Point
+}
+
+func (b Box) contains(p Point) bool {
+	if p.Lat < b.Min.Lat || p.Lat > b.Max.Lat {
+		return false
+	}
+	if b.Min.Lng <= b.Max.Lng {
+		return p.Lng >= b.Min.Lng && p.Lng <= b.Max.Lng
+	}
+	return p.Lng >= b.Min.Lng || p.Lng <= b.Max.Lng
+}
+
+func (b Box) center() Point {
+	c := Point{Lat: (b.Min.Lat + b.Max.Lat) / 2}
+	if b.Min.Lng <= b.Max.Lng {
+		c.Lng = (b.Min.Lng + b.Max.Lng) / 2
+		return c
+	}
+	c.Lng = (b.Min.Lng + b.Max.Lng + 360) / 2
+	if c.Lng > 180 {
+		c.Lng -= 360
+	}
+	return c
+}
+
+// Distance returns the great-circle distance between a and b in meters.
+func Distance(a, b Point) float64 {
+	lat1, lat2 := radians(a.Lat), radians(b.Lat)
+	dlat := lat2 - lat1
+	dlng := radians(b.Lng - a.Lng)
+	h := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dlng/2)*math.Sin(dlng/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func radians(deg float64) float64 { return deg * math.Pi / 180 }
+
+//-----------------------------------------------------------------------------
+
+// PointFn extracts the points of a document.
+type PointFn func(key, val []byte) ([]Point, error)
+
+// Index is a geospatial index. Points are emitted as a peripheral index,
+// so the underlying index (see Index.Index) must be maintained like
+// any other index - for example by registering it in a peripheral.Registry.
+type Index struct {
+	index *peripheral.Index
+}
+
+// NewIndex creates a geospatial index.
+func NewIndex(name string, pointFn PointFn, opts ...peripheral.IndexOption) *Index {
+	if pointFn == nil {
+		panic("pointFn must be provided")
+	}
+	res := &Index{}
+	res.index = peripheral.NewIndex(name, func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		points, err := pointFn(key, val)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[uint64]bool)
+		for _, p := range points {
+			if !p.valid() {
+				return nil, ErrInvalidPoint
+			}
+			z := encode(p)
+			if seen[z] {
+				continue
+			}
+			seen[z] = true
+			entries = append(entries, peripheral.IndexEntry{
+				Fields: []interface{}{z},
+				Val:    encodePoint(p),
+			})
+		}
+		return
+	}, opts...)
+	return res
+}
+
+// Index returns the underlying peripheral index.
+func (ix *Index) Index() *peripheral.Index { return ix.index }
+
+//-----------------------------------------------------------------------------
+
+// Hit .
+type Hit struct {
+	Key   []byte
+	Point Point
+
+	// Distance is in meters, from the center of the query.
+	Distance float64
+}
+
+// Near returns documents with a point within radius (in meters) of center,
+// sorted by distance. If a document has more than one point, the closest
+// one is returned. If limit is provided, only the limit closest
+// documents are returned.
+func (ix *Index) Near(txn *layer.Txn, center Point, radius float64, limit int) ([]Hit, error) {
+	if !center.valid() || radius < 0 {
+		return nil, ErrInvalidPoint
+	}
+	dlat := radius / EarthRadius * 180 / math.Pi
+	box := Box{
+		Min: Point{Lat: center.Lat - dlat, Lng: -180},
+		Max: Point{Lat: center.Lat + dlat, Lng: 180},
+	}
+	if box.Min.Lat < -90 || box.Max.Lat > 90 {
+		// covers a pole
+		box.Min.Lat = math.Max(box.Min.Lat, -90)
+		box.Max.Lat = math.Min(box.Max.Lat, 90)
+	} else {
+		maxLat := math.Max(math.Abs(box.Min.Lat), math.Abs(box.Max.Lat))
+		dlng := dlat / math.Cos(radians(maxLat))
+		if dlng < 180 {
+			box.Min.Lng = wrap(center.Lng - dlng)
+			box.Max.Lng = wrap(center.Lng + dlng)
+		}
+	}
+	return ix.search(txn, box, center, limit, func(p Point, d float64) bool {
+		return d <= radius
+	})
+}
+
+// Within returns documents with a point inside box, sorted by distance
+// from the center of box. If limit is provided, only the limit closest
+// documents are returned.
+func (ix *Index) Within(txn *layer.Txn, box Box, limit int) ([]Hit, error) {
+	if !box.Min.valid() || !box.Max.valid() || box.Min.Lat > box.Max.Lat {
+		return nil, ErrInvalidBox
+	}
+	return ix.search(txn, box, box.center(), limit, func(p Point, _ float64) bool {
+		return box.contains(p)
+	})
+}
+
+func (ix *Index) search(
+	txn *layer.Txn,
+	box Box,
+	center Point,
+	limit int,
+	filter func(p Point, distance float64) bool) (hits []Hit, reserr error) {
+	found := make(map[string]int)
+	for _, r := range cover(box) {
+		q := peripheral.Q{Index: ix.index.Name(), From: r.from, To: r.to}
+		reserr = peripheral.Scan(txn, q, func(rs peripheral.Res) (bool, error) {
+			p, err := decodePoint(rs.Val)
+			if err != nil {
+				return false, err
+			}
+			d := Distance(center, p)
+			if !filter(p, d) {
+				return false, nil
+			}
+			if i, ok := found[string(rs.Key)]; ok {
+				if d < hits[i].Distance {
+					hits[i].Point, hits[i].Distance = p, d
+				}
+				return false, nil
+			}
+			found[string(rs.Key)] = len(hits)
+			hits = append(hits, Hit{Key: append([]byte{}, rs.Key...), Point: p, Distance: d})
+			return false, nil
+		})
+		if reserr != nil {
+			return
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Distance != hits[j].Distance {
+			return hits[i].Distance < hits[j].Distance
+		}
+		return bytes.Compare(hits[i].Key, hits[j].Key) < 0
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return
+}
+
+func wrap(lng float64) float64 {
+	for lng < -180 {
+		lng += 360
+	}
+	for lng > 180 {
+		lng -= 360
+	}
+	return lng
+}
+
+//-----------------------------------------------------------------------------
+
+// cellRange is a range of z values, from (inclusive), to (exclusive).
+type cellRange struct {
+	from, to uint64
+}
+
+// cover returns the ranges of the cells covering box, at the deepest level
+// where box spans at most two cells per axis. Adjacent ranges are merged.
+func cover(box Box) (ranges []cellRange) {
+	if box.Min.Lng > box.Max.Lng {
+		// crosses the antimeridian
+		west := Box{Min: box.Min, Max: Point{Lat: box.Max.Lat, Lng: 180}}
+		east := Box{Min: Point{Lat: box.Min.Lat, Lng: -180}, Max: box.Max}
+		return merge(append(cover(west), cover(east)...))
+	}
+
+	level := maxLevel
+	for ; level > 0; level-- {
+		size := float64(uint64(1) << uint(level))
+		if (box.Max.Lat-box.Min.Lat)/180*size <= 1 && (box.Max.Lng-box.Min.Lng)/360*size <= 1 {
+			break
+		}
+	}
+
+	shift := uint(2 * (maxLevel - level))
+	lat0, lat1 := cell(box.Min.Lat, -90, 180, level), cell(box.Max.Lat, -90, 180, level)
+	lng0, lng1 := cell(box.Min.Lng, -180, 360, level), cell(box.Max.Lng, -180, 360, level)
+	for i := lat0; i <= lat1; i++ {
+		for j := lng0; j <= lng1; j++ {
+			z := interleave(i, j)
+			ranges = append(ranges, cellRange{from: z << shift, to: (z + 1) << shift})
+		}
+	}
+	return merge(ranges)
+}
+
+func merge(ranges []cellRange) (res []cellRange) {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].from < ranges[j].from })
+	for _, r := range ranges {
+		if n := len(res); n > 0 && r.from <= res[n-1].to {
+			if r.to > res[n-1].to {
+				res[n-1].to = r.to
+			}
+			continue
+		}
+		res = append(res, r)
+	}
+	return
+}
+
+// cell returns the index of the cell of v, on an axis starting at min
+// with the length of span, at level.
+func cell(v, min, span float64, level int) uint32 {
+	n := uint64(1) << uint(level)
+	c := uint64((v - min) / span * float64(n))
+	if c >= n {
+		c = n - 1
+	}
+	return uint32(c)
+}
+
+func encode(p Point) uint64 {
+	return interleave(cell(p.Lat, -90, 180, maxLevel), cell(p.Lng, -180, 360, maxLevel))
+}
+
+// interleave interleaves the bits of lat and lng, lat bits first.
+func interleave(lat, lng uint32) (z uint64) {
+	for i := 31; i >= 0; i-- {
+		z = z<<2 | uint64(lat>>uint(i)&1)<<1 | uint64(lng>>uint(i)&1)
+	}
+	return
+}
+
+func encodePoint(p Point) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, math.Float64bits(p.Lat))
+	binary.BigEndian.PutUint64(buf[8:], math.Float64bits(p.Lng))
+	return buf
+}
+
+func decodePoint(b []byte) (p Point, reserr error) {
+	if len(b) != 16 {
+		reserr = ErrInvalidPoint
+		return
+	}
+	p.Lat = math.Float64frombits(binary.BigEndian.Uint64(b))
+	p.Lng = math.Float64frombits(binary.BigEndian.Uint64(b[8:]))
+	return
+}
+
+//-----------------------------------------------------------------------------
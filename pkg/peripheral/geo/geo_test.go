@@ -0,0 +1,177 @@
+package geo_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dc0d/positive/pkg/layer"
+	"github.com/dc0d/positive/pkg/peripheral"
+	"github.com/dc0d/positive/pkg/peripheral/geo"
+	"github.com/stretchr/testify/require"
+)
+
+func mkdir(d string) {
+	if err := os.MkdirAll(d, 0777); err != nil {
+		if !os.IsExist(err) {
+			panic(err)
+		}
+	}
+}
+
+func createDB(databaseDir string, deleteExisting bool) *layer.DB {
+	if databaseDir == "" {
+		databaseDir, _ = ioutil.TempDir(os.TempDir(), "database")
+	} else {
+		databaseDir = filepath.Join(os.TempDir(), databaseDir)
+	}
+	mkdir(databaseDir)
+
+	if deleteExisting {
+		stat, err := os.Stat(databaseDir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				panic(err)
+			}
+		}
+		if stat != nil {
+			if err := os.RemoveAll(databaseDir); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	index := filepath.Join(databaseDir, "index")
+	data := filepath.Join(databaseDir, "data")
+
+	mkdir(index)
+	mkdir(data)
+
+	var opts = layer.DefaultOptions
+	opts.Dir = index
+	opts.ValueDir = data
+	preppedDB, err := layer.Open(opts)
+	if err != nil {
+		panic(err)
+	}
+
+	return preppedDB
+}
+
+func TestDistance(t *testing.T) {
+	require := require.New(t)
+
+	paris := geo.Point{Lat: 48.8566, Lng: 2.3522}
+	london := geo.Point{Lat: 51.5074, Lng: -0.1278}
+	require.InDelta(343500, geo.Distance(paris, london), 1000)
+	require.Equal(0.0, geo.Distance(paris, paris))
+}
+
+func TestIndex(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	type place struct {
+		Name string    `json:"name"`
+		At   geo.Point `json:"at"`
+	}
+
+	ix := geo.NewIndex("at", func(key, val []byte) ([]geo.Point, error) {
+		var p place
+		if err := json.Unmarshal(val, &p); err != nil {
+			return nil, err
+		}
+		return []geo.Point{p.At}, nil
+	})
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(ix.Index()))
+	registry.Attach(db)
+
+	places := []place{
+		{Name: "notre-dame", At: geo.Point{Lat: 48.8530, Lng: 2.3499}},
+		{Name: "eiffel", At: geo.Point{Lat: 48.8584, Lng: 2.2945}},
+		{Name: "versailles", At: geo.Point{Lat: 48.8049, Lng: 2.1204}},
+		{Name: "london", At: geo.Point{Lat: 51.5074, Lng: -0.1278}},
+		{Name: "suva", At: geo.Point{Lat: -18.1416, Lng: 178.4419}},
+		{Name: "apia", At: geo.Point{Lat: -13.8333, Lng: -171.7500}},
+	}
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		for _, p := range places {
+			js, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set([]byte("PLACE:"+p.Name), js); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	keys := func(hits []geo.Hit) (res []string) {
+		for _, h := range hits {
+			res = append(res, string(h.Key))
+		}
+		return
+	}
+
+	center := geo.Point{Lat: 48.8566, Lng: 2.3522}
+	require.NoError(db.View(func(txn *layer.Txn) error {
+		hits, err := ix.Near(txn, center, 5000, 0)
+		require.NoError(err)
+		require.Equal([]string{"PLACE:notre-dame", "PLACE:eiffel"}, keys(hits))
+		require.True(hits[0].Distance < hits[1].Distance)
+
+		hits, err = ix.Near(txn, center, 20000, 0)
+		require.NoError(err)
+		require.Equal([]string{"PLACE:notre-dame", "PLACE:eiffel", "PLACE:versailles"}, keys(hits))
+
+		hits, err = ix.Near(txn, center, 20000, 1)
+		require.NoError(err)
+		require.Equal([]string{"PLACE:notre-dame"}, keys(hits))
+
+		hits, err = ix.Near(txn, center, 500000, 0)
+		require.NoError(err)
+		require.Equal(4, len(hits))
+		require.Equal("PLACE:london", string(hits[3].Key))
+
+		hits, err = ix.Within(txn, geo.Box{
+			Min: geo.Point{Lat: 48.8, Lng: 2.1},
+			Max: geo.Point{Lat: 48.86, Lng: 2.3},
+		}, 0)
+		require.NoError(err)
+		require.ElementsMatch([]string{"PLACE:eiffel", "PLACE:versailles"}, keys(hits))
+
+		// crossing the antimeridian
+		hits, err = ix.Within(txn, geo.Box{
+			Min: geo.Point{Lat: -20, Lng: 170},
+			Max: geo.Point{Lat: -10, Lng: -170},
+		}, 0)
+		require.NoError(err)
+		require.ElementsMatch([]string{"PLACE:suva", "PLACE:apia"}, keys(hits))
+
+		hits, err = ix.Near(txn, geo.Point{Lat: -16, Lng: 180}, 1500000, 0)
+		require.NoError(err)
+		require.ElementsMatch([]string{"PLACE:suva", "PLACE:apia"}, keys(hits))
+
+		_, err = ix.Near(txn, geo.Point{Lat: 91}, 1, 0)
+		require.Equal(geo.ErrInvalidPoint, err)
+		return nil
+	}))
+
+	// moving a document updates its cell
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		js, _ := json.Marshal(place{Name: "london", At: geo.Point{Lat: 48.8570, Lng: 2.3520}})
+		return txn.Set([]byte("PLACE:london"), js)
+	}))
+	require.NoError(db.View(func(txn *layer.Txn) error {
+		hits, err := ix.Near(txn, center, 100, 0)
+		require.NoError(err)
+		require.Equal([]string{"PLACE:london"}, keys(hits))
+		return nil
+	}))
+}
@@ -0,0 +1,34 @@
+package peripheral
+
+import (
+	"fmt"
+)
+
+//-----------------------------------------------------------------------------
+
+// The hash of an index is the 64-bit FNV-1a hash of its name, as 16 hex
+// characters. Hashes set by ID and LongHash start with a non-hex
+// character, so they never share a keyspace with name hashes, or with
+// each other.
+
+// ID makes the index to use a stable numeric id as its hash,
+// instead of the hash of its name.
+//
+// Queries find the hash of an index by its name from the catalog,
+// so the index must be defined - see DefineIndex. A Registry refuses
+// to emit the index, until it is defined.
+func ID(id uint64) IndexOption {
+	return func(ix *Index) { ix.hash = fmt.Sprintf("n%016x", id) }
+}
+
+// LongHash makes the index to use the 128-bit FNV-1a hash of its name,
+// instead of the 64-bit one.
+//
+// Queries find the hash of an index by its name from the catalog,
+// so the index must be defined - see DefineIndex. A Registry refuses
+// to emit the index, until it is defined.
+func LongHash() IndexOption {
+	return func(ix *Index) { ix.hash = "x" + string(fnvhash128([]byte(ix.name))) }
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,126 @@
+// Package keyenc provides order preserving encoders for index values,
+// so that the byte order of encoded values is the same as the natural
+// order of the values - which makes range queries work for numbers and times.
+package keyenc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// error
+var (
+	ErrInvalidEncoding = fmt.Errorf("invalid encoding")
+	ErrUnsupportedType = fmt.Errorf("unsupported type")
+)
+
+//-----------------------------------------------------------------------------
+
+// Int64 encodes v in 8 bytes, negative numbers come first.
+func Int64(v int64) []byte { return Uint64(uint64(v) ^ (1 << 63)) }
+
+// DecodeInt64 .
+func DecodeInt64(b []byte) (int64, error) {
+	u, err := DecodeUint64(b)
+	if err != nil {
+		return 0, err
+	}
+	return int64(u ^ (1 << 63)), nil
+}
+
+// Uint64 encodes v in 8 bytes, big endian.
+func Uint64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// DecodeUint64 .
+func DecodeUint64(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, ErrInvalidEncoding
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// Float64 encodes v in 8 bytes. NaN values are placed after +Inf,
+// and all of them are encoded the same, regardless of sign and payload.
+func Float64(v float64) []byte {
+	if math.IsNaN(v) {
+		v = math.NaN()
+	}
+	u := math.Float64bits(v)
+	if u&(1<<63) != 0 {
+		u = ^u
+	} else {
+		u |= 1 << 63
+	}
+	return Uint64(u)
+}
+
+// DecodeFloat64 .
+func DecodeFloat64(b []byte) (float64, error) {
+	u, err := DecodeUint64(b)
+	if err != nil {
+		return 0, err
+	}
+	if u&(1<<63) != 0 {
+		u &^= 1 << 63
+	} else {
+		u = ^u
+	}
+	return math.Float64frombits(u), nil
+}
+
+// Time encodes t in 12 bytes, as seconds and nanoseconds since unix epoch.
+// The location of t is not stored, decoded times are in UTC.
+func Time(t time.Time) []byte {
+	b := make([]byte, 12)
+	copy(b, Int64(t.Unix()))
+	binary.BigEndian.PutUint32(b[8:], uint32(t.Nanosecond()))
+	return b
+}
+
+// DecodeTime .
+func DecodeTime(b []byte) (time.Time, error) {
+	if len(b) != 12 {
+		return time.Time{}, ErrInvalidEncoding
+	}
+	sec, err := DecodeInt64(b[:8])
+	if err != nil {
+		return time.Time{}, err
+	}
+	nsec := binary.BigEndian.Uint32(b[8:])
+	if nsec >= 1e9 {
+		return time.Time{}, ErrInvalidEncoding
+	}
+	return time.Unix(sec, int64(nsec)).UTC(), nil
+}
+
+// String .
+func String(s string) []byte { return []byte(s) }
+
+// DecodeString .
+func DecodeString(b []byte) (string, error) { return string(b), nil }
+
+// Bool encodes v in 1 byte, false comes first.
+func Bool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// DecodeBool .
+func DecodeBool(b []byte) (bool, error) {
+	if len(b) != 1 || b[0] > 1 {
+		return false, ErrInvalidEncoding
+	}
+	return b[0] == 1, nil
+}
+
+//-----------------------------------------------------------------------------
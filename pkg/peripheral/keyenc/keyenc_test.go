@@ -0,0 +1,146 @@
+package keyenc
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requireOrdered(t *testing.T, encoded [][]byte) {
+	t.Helper()
+	for i := 1; i < len(encoded); i++ {
+		require.True(t, bytes.Compare(encoded[i-1], encoded[i]) < 0, "%x %x", encoded[i-1], encoded[i])
+	}
+}
+
+func TestInt64(t *testing.T) {
+	require := require.New(t)
+
+	values := []int64{math.MinInt64, -1 << 40, -256, -1, 0, 1, 255, 256, 1 << 40, math.MaxInt64}
+	var encoded [][]byte
+	for _, v := range values {
+		b := Int64(v)
+		encoded = append(encoded, b)
+		d, err := DecodeInt64(b)
+		require.NoError(err)
+		require.Equal(v, d)
+	}
+	requireOrdered(t, encoded)
+
+	_, err := DecodeInt64([]byte{1})
+	require.Equal(ErrInvalidEncoding, err)
+}
+
+func TestUint64(t *testing.T) {
+	require := require.New(t)
+
+	values := []uint64{0, 1, 255, 256, 1 << 40, math.MaxUint64}
+	var encoded [][]byte
+	for _, v := range values {
+		b := Uint64(v)
+		encoded = append(encoded, b)
+		d, err := DecodeUint64(b)
+		require.NoError(err)
+		require.Equal(v, d)
+	}
+	requireOrdered(t, encoded)
+}
+
+func TestFloat64(t *testing.T) {
+	require := require.New(t)
+
+	values := []float64{math.Inf(-1), -math.MaxFloat64, -1e10, -1.5, -math.SmallestNonzeroFloat64, 0, math.SmallestNonzeroFloat64, 0.5, 1, 1e10, math.MaxFloat64, math.Inf(1)}
+	var encoded [][]byte
+	for _, v := range values {
+		b := Float64(v)
+		encoded = append(encoded, b)
+		d, err := DecodeFloat64(b)
+		require.NoError(err)
+		require.Equal(v, d)
+	}
+	requireOrdered(t, encoded)
+
+	negativeNaN := math.Float64frombits(math.Float64bits(math.NaN()) | 1<<63)
+	for _, nan := range []float64{math.NaN(), negativeNaN} {
+		b := Float64(nan)
+		require.Equal(Float64(math.NaN()), b)
+		requireOrdered(t, [][]byte{Float64(math.Inf(-1)), Float64(math.Inf(1)), b})
+		d, err := DecodeFloat64(b)
+		require.NoError(err)
+		require.True(math.IsNaN(d))
+	}
+}
+
+func TestTime(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	values := []time.Time{
+		time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Unix(0, 0),
+		now,
+		now.Add(time.Nanosecond),
+		now.Add(time.Second),
+		time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	var encoded [][]byte
+	for _, v := range values {
+		b := Time(v)
+		encoded = append(encoded, b)
+		d, err := DecodeTime(b)
+		require.NoError(err)
+		require.True(v.Equal(d))
+	}
+	requireOrdered(t, encoded)
+}
+
+func TestBoolString(t *testing.T) {
+	require := require.New(t)
+
+	requireOrdered(t, [][]byte{Bool(false), Bool(true)})
+	v, err := DecodeBool(Bool(true))
+	require.NoError(err)
+	require.True(v)
+	_, err = DecodeBool([]byte{2})
+	require.Equal(ErrInvalidEncoding, err)
+
+	requireOrdered(t, [][]byte{String(""), String("a"), String("ab"), String("b")})
+	s, err := DecodeString(String("ab"))
+	require.NoError(err)
+	require.Equal("ab", s)
+}
+
+func TestTuple(t *testing.T) {
+	require := require.New(t)
+
+	at := time.Date(2018, 8, 1, 10, 0, 0, 0, time.UTC)
+	b, err := Tuple("frodo", at, -1, uint64(2), 1.5, true, []byte{0, 1})
+	require.NoError(err)
+	vals, err := DecodeTuple(b)
+	require.NoError(err)
+	require.Equal([]interface{}{"frodo", at, int64(-1), uint64(2), 1.5, true, []byte{0, 1}}, vals)
+
+	_, err = Tuple(struct{}{})
+	require.Equal(ErrUnsupportedType, err)
+
+	_, err = DecodeTuple(b[:len(b)-1])
+	require.Equal(ErrInvalidEncoding, err)
+
+	requireOrdered(t, [][]byte{
+		MustTuple("a"),
+		MustTuple("a", -10),
+		MustTuple("a", 0),
+		MustTuple("a", 10),
+		MustTuple("a\x00"),
+		MustTuple("ab", -10),
+		MustTuple("b"),
+	})
+
+	prefix := MustTuple("frodo")
+	require.True(bytes.HasPrefix(MustTuple("frodo", at), prefix))
+	require.False(bytes.HasPrefix(MustTuple("frodo baggins", at), prefix))
+}
@@ -0,0 +1,172 @@
+package keyenc
+
+import (
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// type tags of tuple elements
+const (
+	tagBool   = 0x10
+	tagInt    = 0x20
+	tagUint   = 0x21
+	tagFloat  = 0x30
+	tagTime   = 0x40
+	tagString = 0x50
+	tagBytes  = 0x51
+)
+
+// variable length elements are escaped (0x00 -> 0x00 0xff)
+// and terminated by 0x00 0x01, to keep the order.
+const (
+	escByte = 0x00
+	escNul  = 0xff
+	escTerm = 0x01
+)
+
+// Tuple encodes vals, in order. Supported types are bool, int, int64, uint64,
+// float64, time.Time, string and []byte. Each element is prefixed by
+// a type tag, so values of the same type (at the same position) keep their order,
+// and the encoding of a tuple is a prefix of the encoding
+// of any longer tuple, starting with the same elements.
+func Tuple(vals ...interface{}) ([]byte, error) {
+	var buf []byte
+	for _, v := range vals {
+		switch x := v.(type) {
+		case bool:
+			buf = append(append(buf, tagBool), Bool(x)...)
+		case int:
+			buf = append(append(buf, tagInt), Int64(int64(x))...)
+		case int64:
+			buf = append(append(buf, tagInt), Int64(x)...)
+		case uint64:
+			buf = append(append(buf, tagUint), Uint64(x)...)
+		case float64:
+			buf = append(append(buf, tagFloat), Float64(x)...)
+		case time.Time:
+			buf = append(append(buf, tagTime), Time(x)...)
+		case string:
+			buf = appendEscaped(append(buf, tagString), []byte(x))
+		case []byte:
+			buf = appendEscaped(append(buf, tagBytes), x)
+		default:
+			return nil, ErrUnsupportedType
+		}
+	}
+	return buf, nil
+}
+
+// MustTuple is like Tuple, but panics on unsupported types.
+func MustTuple(vals ...interface{}) []byte {
+	b, err := Tuple(vals...)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// DecodeTuple decodes a tuple, encoded by Tuple. Integers are decoded
+// as int64, and times are in UTC.
+func DecodeTuple(b []byte) (res []interface{}, reserr error) {
+	for len(b) > 0 {
+		tag := b[0]
+		b = b[1:]
+		var (
+			v    interface{}
+			size int
+			err  error
+		)
+		switch tag {
+		case tagBool:
+			size = 1
+			if len(b) >= size {
+				v, err = DecodeBool(b[:size])
+			}
+		case tagInt:
+			size = 8
+			if len(b) >= size {
+				v, err = DecodeInt64(b[:size])
+			}
+		case tagUint:
+			size = 8
+			if len(b) >= size {
+				v, err = DecodeUint64(b[:size])
+			}
+		case tagFloat:
+			size = 8
+			if len(b) >= size {
+				v, err = DecodeFloat64(b[:size])
+			}
+		case tagTime:
+			size = 12
+			if len(b) >= size {
+				v, err = DecodeTime(b[:size])
+			}
+		case tagString, tagBytes:
+			var raw []byte
+			raw, size, err = readEscaped(b)
+			if tag == tagString {
+				v = string(raw)
+			} else {
+				v = raw
+			}
+		default:
+			reserr = ErrInvalidEncoding
+			return
+		}
+		if err != nil {
+			reserr = err
+			return
+		}
+		if len(b) < size {
+			reserr = ErrInvalidEncoding
+			return
+		}
+		res = append(res, v)
+		b = b[size:]
+	}
+	return
+}
+
+//-----------------------------------------------------------------------------
+
+func appendEscaped(dst, b []byte) []byte {
+	for _, c := range b {
+		if c == escByte {
+			dst = append(dst, escByte, escNul)
+			continue
+		}
+		dst = append(dst, c)
+	}
+	return append(dst, escByte, escTerm)
+}
+
+func readEscaped(b []byte) (raw []byte, size int, err error) {
+	raw = []byte{}
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if c != escByte {
+			raw = append(raw, c)
+			continue
+		}
+		if i+1 >= len(b) {
+			break
+		}
+		switch b[i+1] {
+		case escNul:
+			raw = append(raw, escByte)
+			i++
+		case escTerm:
+			size = i + 2
+			return
+		default:
+			err = ErrInvalidEncoding
+			return
+		}
+	}
+	err = ErrInvalidEncoding
+	return
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,185 @@
+package peripheral
+
+import (
+	"bytes"
+	"fmt"
+)
+
+//-----------------------------------------------------------------------------
+
+// Index keys are laid out as:
+//
+//	K2X: ^<hash>} <key> <index>  ->  X2K key
+//	X2K: ^<hash>{ <index> <key>  ->  IndexEntry.Val
+//
+// where each <segment> is escaped (0x00 -> 0x00 0xff) and terminated
+// by 0x00 0x01. The escaping keeps the byte order of the raw values,
+// so range and prefix queries work as before, while segments
+// can hold any byte sequence.
+const (
+	indexSpace = "^"
+	indexK2X   = "}"
+	indexX2K   = "{"
+)
+
+const (
+	escByte = 0x00
+	escNul  = 0xff
+	escTerm = 0x01
+
+	// escAfter comes after the terminator, and before any continuation
+	// of a segment, so <escaped value> escByte escAfter is the upper bound
+	// of all keys with that exact segment.
+	escAfter = 0x02
+)
+
+// error
+var (
+	ErrInvalidIndexKey = fmt.Errorf("invalid index key")
+)
+
+// isReserved reports if key belongs to an index keyspace, or the catalog.
+// Other keys starting with indexSpace are documents.
+func isReserved(key []byte) bool { return reservedPrefix(key) != nil }
+
+// reservedPrefix returns the prefix of the reserved keyspace of key
+// (^<hash>}, ^<hash>{, ^<hash>= or ^#), or nil if key is a document.
+func reservedPrefix(key []byte) []byte {
+	if !bytes.HasPrefix(key, []byte(indexSpace)) {
+		return nil
+	}
+	rest := key[len(indexSpace):]
+	if bytes.HasPrefix(rest, []byte(indexCatalog)) {
+		return key[:len(indexSpace)+len(indexCatalog)]
+	}
+	n := hashLen(rest)
+	if n == 0 || len(rest) <= n {
+		return nil
+	}
+	switch string(rest[n]) {
+	case indexK2X, indexX2K, indexUnique:
+		return key[:len(indexSpace)+n+1]
+	}
+	return nil
+}
+
+// hashLen returns the length of the index hash at the start of b,
+// or zero if b does not start with a hash - see fnvhash, ID and LongHash.
+func hashLen(b []byte) int {
+	n, start := 16, 0
+	if len(b) > 0 {
+		switch b[0] {
+		case 'n':
+			n, start = 17, 1
+		case 'x':
+			n, start = 33, 1
+		}
+	}
+	if len(b) < n {
+		return 0
+	}
+	for _, c := range b[start:n] {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return 0
+		}
+	}
+	return n
+}
+
+func space(hash, domain string) []byte {
+	return []byte(indexSpace + hash + domain)
+}
+
+func k2xPrefix(hash string, key []byte) []byte {
+	return appendSegment(space(hash, indexK2X), key)
+}
+
+func k2xKey(hash string, key, index []byte) []byte {
+	return appendSegment(k2xPrefix(hash, key), index)
+}
+
+func x2kKey(hash string, index, key []byte) []byte {
+	return appendSegment(appendSegment(space(hash, indexX2K), index), key)
+}
+
+// successor returns the smallest key, greater than all keys with prefix.
+func successor(prefix []byte) []byte {
+	res := append([]byte{}, prefix...)
+	for i := len(res) - 1; i >= 0; i-- {
+		if res[i] < 0xff {
+			res[i]++
+			return res[:i+1]
+		}
+	}
+	return append(prefix, 0xff)
+}
+
+// appendEscaped appends the escaped form of b without the terminator,
+// which is a prefix of the escaped form of any value prefixed by b.
+func appendEscaped(dst, b []byte) []byte {
+	for _, c := range b {
+		if c == escByte {
+			dst = append(dst, escByte, escNul)
+			continue
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+func appendSegment(dst, b []byte) []byte {
+	return append(appendEscaped(dst, b), escByte, escTerm)
+}
+
+// readSegment decodes the first segment of b.
+func readSegment(b []byte) (seg, rest []byte, err error) {
+	seg = []byte{}
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if c != escByte {
+			seg = append(seg, c)
+			continue
+		}
+		if i+1 >= len(b) {
+			break
+		}
+		i++
+		switch b[i] {
+		case escNul:
+			seg = append(seg, escByte)
+		case escTerm:
+			rest = b[i+1:]
+			return
+		default:
+			err = ErrInvalidIndexKey
+			return
+		}
+	}
+	err = ErrInvalidIndexKey
+	return
+}
+
+// splitIndexKey decodes an index key from domain (K2X or X2K),
+// into its two segments, in order of appearance.
+func splitIndexKey(k []byte, hash, domain string) (first, second []byte, err error) {
+	pfx := space(hash, domain)
+	if !bytes.HasPrefix(k, pfx) {
+		err = ErrInvalidIndexKey
+		return
+	}
+	var rest []byte
+	first, rest, err = readSegment(k[len(pfx):])
+	if err != nil {
+		return
+	}
+	second, rest, err = readSegment(rest)
+	if err != nil {
+		return
+	}
+	if len(rest) > 0 {
+		err = ErrInvalidIndexKey
+	}
+	return
+}
+
+//-----------------------------------------------------------------------------
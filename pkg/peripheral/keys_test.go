@@ -0,0 +1,80 @@
+package peripheral
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegment(t *testing.T) {
+	require := require.New(t)
+
+	values := [][]byte{
+		{},
+		[]byte("a"),
+		[]byte("a^b"),
+		{0},
+		{0, 1},
+		{0, 0xff},
+		{'a', 0},
+		{'a', 0, 0},
+		{'a', 1},
+		{0xff},
+	}
+
+	for _, v := range values {
+		seg, rest, err := readSegment(appendSegment(nil, v))
+		require.NoError(err)
+		require.Equal(v, seg)
+		require.Equal(0, len(rest))
+	}
+
+	for _, a := range values {
+		for _, b := range values {
+			ea, eb := appendSegment(nil, a), appendSegment(nil, b)
+			require.Equal(bytes.Compare(a, b), bytes.Compare(ea, eb), "%q %q", a, b)
+			if bytes.HasPrefix(b, a) {
+				require.True(bytes.HasPrefix(eb, appendEscaped(nil, a)), "%q %q", a, b)
+			}
+		}
+	}
+
+	first, second, err := splitIndexKey(x2kKey("h", []byte("^a^"), []byte{0, 1, 0}), "h", indexX2K)
+	require.NoError(err)
+	require.Equal([]byte("^a^"), first)
+	require.Equal([]byte{0, 1, 0}, second)
+
+	_, _, err = splitIndexKey(x2kKey("h", []byte("a"), []byte("b")), "h", indexK2X)
+	require.Equal(ErrInvalidIndexKey, err)
+	_, _, err = splitIndexKey([]byte("^h{a\x00\x01b"), "h", indexX2K)
+	require.Equal(ErrInvalidIndexKey, err)
+}
+
+func TestIsReserved(t *testing.T) {
+	require := require.New(t)
+
+	hash := string(fnvhash([]byte("val")))
+	for _, k := range []string{
+		"^#val",
+		"^" + hash + "}",
+		"^" + hash + "{x",
+		"^" + hash + "=x",
+		"^n0000000000000001{x",
+		"^x" + string(fnvhash128([]byte("val"))) + "}x",
+	} {
+		require.True(isReserved([]byte(k)), k)
+	}
+	for _, k := range []string{
+		"",
+		"^",
+		"^user1",
+		"^" + hash,
+		"^" + hash + "x",
+		"^" + hash[:15] + "{",
+		"^n01{x",
+		"USER:" + hash + "{",
+	} {
+		require.False(isReserved([]byte(k)), k)
+	}
+}
@@ -0,0 +1,145 @@
+package peripheral
+
+import (
+	"bytes"
+
+	"github.com/dc0d/positive/pkg/layer"
+)
+
+//-----------------------------------------------------------------------------
+
+// legacy layout, used before segment encoding:
+//
+//	K2X: ^<hash>>^<key>^<index>  ->  X2K key
+//	X2K: ^<hash><^<index>^<key>  ->  IndexEntry.Val
+const (
+	legacyK2X = ">"
+	legacyX2K = "<"
+)
+
+// MigrateLegacyLayout moves indexes written with the legacy key layout
+// (^<hash>>^<key>^<index> and ^<hash><^<index>^<key>) to the current one.
+// The legacy layout can not be decoded safely when keys or index values
+// contain '^', so the legacy entries are deleted and the indexes are
+// emitted again for all documents. Each batch is committed in
+// its own transaction, so it is safe to run it again after an interruption.
+// Legacy keys of other indexes are not emitted as documents, and left
+// as they are.
+func MigrateLegacyLayout(db *layer.DB, batchSize int, indexes ...*Index) error {
+	for _, ix := range indexes {
+		for _, domain := range []string{legacyK2X, legacyX2K} {
+			prefix := []byte(indexSpace + ix.hash + domain + indexSpace)
+			_, err := batchUpdate(db, prefix, batchSize, false, func(txn *layer.Txn, key, _ []byte) error {
+				return txn.Delete(key)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := batchUpdate(db, nil, batchSize, true, func(txn *layer.Txn, key, val []byte) error {
+		if isReserved(key) || isLegacy(key) {
+			return nil
+		}
+		for _, ix := range indexes {
+			if err := Emit(txn, ix, key, document(val)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// isLegacy reports if key is in a legacy index domain (^<hash>>^ or ^<hash><^),
+// of any index - not only the ones being migrated.
+func isLegacy(key []byte) bool {
+	if !bytes.HasPrefix(key, []byte(indexSpace)) {
+		return false
+	}
+	rest := key[len(indexSpace):]
+	n := hashLen(rest)
+	if n == 0 || len(rest) <= n+len(indexSpace) {
+		return false
+	}
+	switch string(rest[n]) {
+	case legacyK2X, legacyX2K:
+		return bytes.HasPrefix(rest[n+1:], []byte(indexSpace))
+	}
+	return false
+}
+
+//-----------------------------------------------------------------------------
+
+// maintain runs fn inside a transaction, which is committed
+// without running commit hooks, since it only maintains index keys.
+func maintain(db *layer.DB, fn func(txn *layer.Txn) error) error {
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+	if err := fn(txn); err != nil {
+		return err
+	}
+	return txn.Txn.Commit(nil)
+}
+
+// batchUpdate walks keys with prefix, in batches of batchSize, each batch
+// inside its own transaction. Batches are committed without running
+// commit hooks, since they only maintain index keys.
+func batchUpdate(
+	db *layer.DB,
+	prefix []byte,
+	batchSize int,
+	withValues bool,
+	fn func(txn *layer.Txn, key, val []byte) error) (total int, reserr error) {
+	if batchSize <= 0 {
+		batchSize = 300
+	}
+	seek := prefix
+	for {
+		var keys, vals [][]byte
+		txn := db.NewTransaction(true)
+		reserr = func() error {
+			defer txn.Discard()
+
+			opt := layer.DefaultIteratorOptions
+			opt.PrefetchValues = withValues
+			itr := txn.NewIterator(opt)
+			for itr.Seek(seek); itr.ValidForPrefix(prefix) && len(keys) < batchSize; itr.Next() {
+				item := itr.Item()
+				keys = append(keys, item.KeyCopy(nil))
+				if !withValues {
+					continue
+				}
+				v, err := item.ValueCopy(nil)
+				if err != nil {
+					itr.Close()
+					return err
+				}
+				vals = append(vals, v)
+			}
+			itr.Close()
+
+			for i, k := range keys {
+				var v []byte
+				if withValues {
+					v = vals[i]
+				}
+				if err := fn(txn, k, v); err != nil {
+					return err
+				}
+			}
+			return txn.Txn.Commit(nil)
+		}()
+		if reserr != nil {
+			return
+		}
+		total += len(keys)
+		if len(keys) < batchSize {
+			return
+		}
+		seek = append(keys[len(keys)-1], 0)
+	}
+}
+
+//-----------------------------------------------------------------------------
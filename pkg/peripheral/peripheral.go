@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"hash/fnv"
+	"regexp"
 
 	"github.com/dc0d/positive/pkg/layer"
 )
@@ -15,6 +16,10 @@ import (
 // IndexEntry .
 type IndexEntry struct {
 	Index, Val []byte
+
+	// Fields of a compound index, if provided, are encoded
+	// using keyenc.Tuple as the index value (instead of Index).
+	Fields []interface{}
 }
 
 // IndexFn .
@@ -25,10 +30,15 @@ type Index struct {
 	name    string
 	indexFn IndexFn
 	hash    string
+	keys    KeySelector
+	unique  bool
+	where   Predicate
+	project []string
+	version int
 }
 
 // NewIndex .
-func NewIndex(name string, indexFn IndexFn) (res *Index) {
+func NewIndex(name string, indexFn IndexFn, opts ...IndexOption) (res *Index) {
 	if name == "" {
 		panic("name must be provided")
 	}
@@ -36,19 +46,123 @@ func NewIndex(name string, indexFn IndexFn) (res *Index) {
 		panic("indexFn must be provided")
 	}
 	res = &Index{name: name, indexFn: indexFn}
-	res.hash = string(fnvhash([]byte(res.name)))
+	for _, opt := range opts {
+		opt(res)
+	}
+	if res.hash == "" {
+		res.hash = string(fnvhash([]byte(res.name)))
+	}
 	return
 }
 
+// Name .
+func (ix *Index) Name() string { return ix.name }
+
+func (ix *Index) accepts(key []byte) bool {
+	if ix.keys == nil {
+		return true
+	}
+	return ix.keys(key)
+}
+
+func (ix *Index) matches(key, val []byte) bool {
+	if ix.where == nil {
+		return true
+	}
+	return ix.where(key, val)
+}
+
+// Partial reports if the index is a partial index (see Where).
+func (ix *Index) Partial() bool { return ix.where != nil }
+
+// IndexOption .
+type IndexOption func(*Index)
+
+// WithKeys makes the index to only see keys accepted by selector,
+// other keys are not passed to the IndexFn.
+func WithKeys(selector KeySelector) IndexOption {
+	return func(ix *Index) { ix.keys = selector }
+}
+
+// Predicate decides if a document should be indexed.
+type Predicate func(key, val []byte) bool
+
+// Where makes the index a partial index, which only indexes documents
+// matching pred. pred is evaluated once per write, and the IndexFn is not
+// called for documents that do not match. With pre-images (see EmitDiff),
+// a write is skipped if neither the previous nor the new document matches;
+// without them, the K2X keys of the document are still scanned, to delete
+// its previous entries.
+func Where(pred Predicate) IndexOption {
+	return func(ix *Index) { ix.where = pred }
+}
+
+//-----------------------------------------------------------------------------
+
+// KeySelector decides if a key should be indexed.
+type KeySelector func(key []byte) bool
+
+// KeyPrefix selects keys with the prefix.
+func KeyPrefix(prefix string) KeySelector {
+	pfx := []byte(prefix)
+	return func(key []byte) bool { return bytes.HasPrefix(key, pfx) }
+}
+
+// KeyRegexp selects keys matching expr.
+func KeyRegexp(expr *regexp.Regexp) KeySelector {
+	return func(key []byte) bool { return expr.Match(key) }
+}
+
 //-----------------------------------------------------------------------------
 
 // Emit .
-func Emit(txn *layer.Txn, ix *Index, key, val []byte) (reserr error) {
-	partk2x := indexSpace + ix.hash + indexK2X
-	partx2k := indexSpace + ix.hash + indexX2K
+func Emit(txn *layer.Txn, ix *Index, key, val []byte) error {
+	em, err := release(txn, ix, key, val)
+	if err != nil {
+		return err
+	}
+	return em.write(txn)
+}
 
-	markedKey := indexSpace + string(key)
-	preppedk := partk2x + markedKey
+// EmitDiff is Emit, for a document changed from prev to val - a nil prev
+// means the document did not exist, and a nil val means it is deleted.
+// Instead of scanning the K2X keys of the document, the entries to delete
+// are calculated from prev, so the index must be up to date with prev
+// and the IndexFn must be deterministic.
+func EmitDiff(txn *layer.Txn, ix *Index, key, prev, val []byte) error {
+	em, err := releaseDiff(txn, ix, key, prev, val)
+	if err != nil {
+		return err
+	}
+	return em.write(txn)
+}
+
+// emission holds the index entries of a document, which are left
+// to be written, after its previous entries are released. Releasing
+// all documents of a transaction before writing any, makes unique
+// checks independent of the order of writes.
+type emission struct {
+	ix     *Index
+	key    []byte
+	writes []entryWrite
+}
+
+type entryWrite struct {
+	entry
+
+	// claim the unique guard, and set the K2X key
+	claim, k2x bool
+}
+
+// release deletes the previous entries of key - found by scanning its K2X
+// keys - and returns the entries to write.
+func release(txn *layer.Txn, ix *Index, key, val []byte) (em emission, reserr error) {
+	em = emission{ix: ix, key: key}
+	if !ix.accepts(key) {
+		return
+	}
+
+	preppedk := k2xPrefix(ix.hash, key)
 
 	opt := layer.DefaultIteratorOptions
 	opt.PrefetchValues = false
@@ -56,7 +170,7 @@ func Emit(txn *layer.Txn, ix *Index, key, val []byte) (reserr error) {
 	// delete previously calculated index for this key
 	itr := txn.NewIterator(opt)
 	defer itr.Close()
-	prefix := []byte(preppedk)
+	prefix := preppedk
 	var toDelete [][]byte
 	for itr.Seek(prefix); itr.ValidForPrefix(prefix); itr.Next() {
 		item := itr.Item()
@@ -66,6 +180,12 @@ func Emit(txn *layer.Txn, ix *Index, key, val []byte) (reserr error) {
 			reserr = err
 			return
 		}
+		if ix.unique {
+			if err := deleteUnique(txn, ix, k); err != nil {
+				reserr = err
+				return
+			}
+		}
 		toDelete = append(toDelete, k)
 		toDelete = append(toDelete, v)
 	}
@@ -78,184 +198,260 @@ func Emit(txn *layer.Txn, ix *Index, key, val []byte) (reserr error) {
 		}
 	}
 
-	if val == nil {
+	entries, err := ix.entries(key, val)
+	if err != nil {
+		reserr = err
+		return
+	}
+	for _, e := range entries {
+		em.writes = append(em.writes, entryWrite{entry: e, claim: ix.unique, k2x: true})
+	}
+	return
+}
+
+// releaseDiff deletes the entries of prev, which are not entries of val,
+// and returns the new or changed entries to write.
+func releaseDiff(txn *layer.Txn, ix *Index, key, prev, val []byte) (em emission, reserr error) {
+	em = emission{ix: ix, key: key}
+	if !ix.accepts(key) {
+		return
+	}
+
+	prevMatches := prev != nil && ix.matches(key, prev)
+	valMatches := val != nil && ix.matches(key, val)
+	if !prevMatches && !valMatches {
+		return
+	}
+
+	var olds, news []entry
+	if prevMatches {
+		if olds, reserr = ix.build(key, prev); reserr != nil {
+			return
+		}
+	}
+	if valMatches {
+		if news, reserr = ix.build(key, val); reserr != nil {
+			return
+		}
+	}
+
+	previous := make(map[string][]byte, len(olds))
+	for _, e := range olds {
+		previous[string(e.index)] = e.val
+	}
+	current := make(map[string]bool, len(news))
+	for _, e := range news {
+		current[string(e.index)] = true
+	}
+
+	for _, e := range olds {
+		if current[string(e.index)] {
+			continue
+		}
+		if ix.unique {
+			if reserr = txn.Delete(uniqueKey(ix.hash, e.index)); reserr != nil {
+				return
+			}
+		}
+		if reserr = txn.Delete(k2xKey(ix.hash, key, e.index)); reserr != nil {
+			return
+		}
+		if reserr = txn.Delete(x2kKey(ix.hash, e.index, key)); reserr != nil {
+			return
+		}
+	}
+
+	for _, e := range news {
+		v, ok := previous[string(e.index)]
+		if ok && bytes.Equal(v, e.val) {
+			continue
+		}
+		em.writes = append(em.writes, entryWrite{entry: e, claim: ix.unique && !ok, k2x: !ok})
+	}
+	return
+}
+
+// write claims the unique guards, and sets the entries.
+func (em emission) write(txn *layer.Txn) (reserr error) {
+	ix := em.ix
+	for _, w := range em.writes {
+		if w.claim {
+			if reserr = claimUnique(txn, ix, em.key, w.index); reserr != nil {
+				return
+			}
+		}
+		x2k := x2kKey(ix.hash, w.index, em.key)
+		if w.k2x {
+			if reserr = txn.Set(k2xKey(ix.hash, em.key, w.index), x2k); reserr != nil {
+				return
+			}
+		}
+		if reserr = txn.Set(x2k, w.val); reserr != nil {
+			return
+		}
+	}
+	return
+}
+
+// entry is an index entry, with its encoded index value.
+type entry struct {
+	index, val []byte
+}
+
+// entries calculates the index entries of a document, a nil val means
+// the document is deleted - and documents not matching a partial index
+// have no entries.
+func (ix *Index) entries(key, val []byte) (res []entry, reserr error) {
+	if val == nil || !ix.matches(key, val) {
 		return
 	}
+	return ix.build(key, val)
+}
 
+// build calls the IndexFn, for a document that matches the index.
+func (ix *Index) build(key, val []byte) (res []entry, reserr error) {
 	var indexEntries []IndexEntry
 	indexEntries, reserr = ix.indexFn(key, val)
 	if reserr != nil {
 		return
 	}
 
-	for _, kv := range indexEntries {
-		wix := indexSpace + string(kv.Index)
-		k2x := preppedk + wix
-		x2k := partx2k + wix + markedKey
-		if reserr = txn.Set([]byte(k2x), []byte(x2k)); reserr != nil {
+	var projection []byte
+	if len(ix.project) > 0 && len(indexEntries) > 0 {
+		if projection, reserr = project(val, ix.project); reserr != nil {
 			return
 		}
-		if reserr = txn.Set([]byte(x2k), kv.Val); reserr != nil {
+	}
+
+	for _, kv := range indexEntries {
+		if kv.Val == nil {
+			kv.Val = projection
+		}
+		var index []byte
+		index, reserr = kv.index()
+		if reserr != nil {
 			return
 		}
+		res = append(res, entry{index: index, val: kv.Val})
 	}
-
 	return
 }
 
-const (
-	indexSpace = "^"
-	indexK2X   = ">"
-	indexX2K   = "<"
-)
-
 //-----------------------------------------------------------------------------
 
 // error
 var (
 	ErrNoIndexNameProvided = fmt.Errorf("no index name provided")
+	ErrInvalidCursor       = fmt.Errorf("invalid cursor")
 )
 
 // QueryIndex .
 func QueryIndex(params Q, txn *layer.Txn, forIndexedKeys ...bool) (reslist []Res, rescount int, reserr error) {
+	if params.Count {
+		rescount, reserr = countIndex(params, txn, forIndexedKeys...)
+		return
+	}
 	params.init()
-	if params.Index == "" {
-		reserr = ErrNoIndexNameProvided
+	fetch := params.FetchDocuments
+	params.FetchDocuments = false
+	reserr = Scan(txn, params, func(rs Res) (bool, error) {
+		reslist = append(reslist, rs.Copy())
+		return false, nil
+	}, forIndexedKeys...)
+	if reserr != nil {
 		return
 	}
-
-	start, end, prefix := stopWords(params, forIndexedKeys...)
-
-	skip, limit, applySkip, applyLimit := getlimits(params)
-
-	body := func(itr interface{ Item() *layer.Item }) error {
-		if params.Count {
-			rescount++
-			skip--
-			if applySkip && skip >= 0 {
-				return nil
-			}
-			if applyLimit && limit <= 0 {
-				return nil
-			}
-			limit--
-			if len(end) > 0 {
-				item := itr.Item()
-				k := item.Key()
-				if bytes.Compare(k, end) > 0 {
-					return nil
-				}
-			}
-			return nil
-		}
-		item := itr.Item()
-		k := item.KeyCopy(nil)
-		// if params.Index == "" && bytes.HasPrefix(k, []byte(indexSpace)) {
-		// 	return nil
-		// }
-		skip--
-		if applySkip && skip >= 0 {
-			return nil
-		}
-		v, err := item.ValueCopy(nil)
-		if err != nil {
-			return err
-		}
-		if applyLimit && limit <= 0 {
-			return nil
-		}
-		limit--
-		if len(end) > 0 {
-			if bytes.Compare(k, end) > 0 {
-				return nil
-			}
-		}
-		var index []byte
-		polishedKey := k
-		// sppfx := []byte(keysp)
-		// if bytes.HasPrefix(polishedKey, sppfx) {
-		// 	polishedKey = bytes.TrimPrefix(polishedKey, sppfx)
-		// }
-		sppfx := []byte(indexSpace)
-		if bytes.HasPrefix(polishedKey, sppfx) {
-			parts := bytes.Split(polishedKey, sppfx)
-			index = parts[2]
-			polishedKey = parts[3]
-		}
-		var rs Res
-		rs.Key = polishedKey
-		rs.Val = v
-		rs.Index = index
-		reslist = append(reslist, rs)
-		return nil
-	}
-
-	qfn := func(txn *layer.Txn) error {
-		var opt = layer.DefaultIteratorOptions
-		opt.PrefetchValues = true
-		opt.PrefetchSize = limit
-		return itrFunc(txn, opt, start, prefix, body)
-	}
-	// if parentTxn == nil {
-	// 	reserr = db.db.View(qfn)
-	// } else {
-	// 	reserr = qfn(parentTxn)
-	// }
-	reserr = qfn(txn)
-	if rescount == 0 {
-		rescount = len(reslist)
+	if fetch {
+		reserr = FetchDocuments(txn, reslist)
 	}
-
+	rescount = len(reslist)
 	return
 }
 
 func itrFunc(txn *layer.Txn,
 	opt layer.IteratorOptions,
-	start, prefix []byte,
-	bodyFunc func(itr interface{ Item() *layer.Item }) error) error {
+	start, end, prefix []byte,
+	afterStart bool,
+	bodyFunc func(item *layer.Item) (stop bool, err error)) error {
 	itr := txn.NewIterator(opt)
 	defer itr.Close()
-	for itr.Seek(start); itr.ValidForPrefix(prefix); itr.Next() {
-		if err := bodyFunc(itr); err != nil {
+	itr.Seek(start)
+	if opt.Reverse && itr.Valid() && !itr.ValidForPrefix(prefix) {
+		// start is the upper bound of prefix, which might be an existing key
+		itr.Next()
+	}
+	if afterStart && itr.Valid() && bytes.Equal(itr.Item().Key(), start) {
+		itr.Next()
+	}
+	for ; itr.ValidForPrefix(prefix); itr.Next() {
+		item := itr.Item()
+		if len(end) > 0 {
+			cmp := bytes.Compare(item.Key(), end)
+			if (!opt.Reverse && cmp > 0) || (opt.Reverse && cmp < 0) {
+				break
+			}
+		}
+		stop, err := bodyFunc(item)
+		if err != nil {
 			return err
 		}
+		if stop {
+			break
+		}
 	}
 	return nil
 }
 
-func stopWords(params Q, forIndexedKeys ...bool) (start, end, prefix []byte) {
-	name := string(fnvhash([]byte(params.Index)))
-	domain := indexX2K
+func getdomain(forIndexedKeys ...bool) string {
 	if len(forIndexedKeys) > 0 && forIndexedKeys[0] {
-		domain = indexK2X
-	}
-	pfx := indexSpace + name + domain
-	start = []byte(pfx + indexSpace + string(params.Start))
-	if len(params.End) > 0 {
-		end = []byte(pfx + indexSpace + string(params.End))
+		return indexK2X
 	}
+	return indexX2K
+}
+
+// stopWords calculates the iteration bounds: the iteration starts at start,
+// and stops at the first key after end (before end, in reverse)
+// or at the first key without prefix.
+func stopWords(params Q, hash, domain string, compound bool) (start, end, prefix []byte) {
+	pfx := space(hash, domain)
 	if len(params.Prefix) > 0 {
-		prefix = []byte(pfx + indexSpace + string(params.Prefix))
+		prefix = appendEscaped(space(hash, domain), params.Prefix)
 	} else {
-		prefix = []byte(pfx)
+		prefix = pfx
 	}
 
-	return
-}
-
-func getlimits(params Q) (skip, limit int, applySkip, applyLimit bool) {
-	skip = params.Skip
-	limit = params.Limit
-	var ()
-	if skip > 0 {
-		applySkip = true
+	if params.Reverse {
+		// in reverse, Start is inclusive and End is exclusive for index values
+		// equal to them, for compound queries the bounds are already exact.
+		upper := successor(prefix)
+		if len(params.Start) > 0 {
+			start = appendEscaped(space(hash, domain), params.Start)
+			if !compound {
+				start = append(start, escByte, escAfter)
+			}
+			if bytes.Compare(start, upper) > 0 {
+				start = upper
+			}
+		} else {
+			start = upper
+		}
+		if len(params.End) > 0 {
+			end = appendEscaped(space(hash, domain), params.End)
+			if !compound {
+				end = append(end, escByte, escAfter)
+			}
+		}
+		return
 	}
-	if limit <= 0 && !params.Count {
-		limit = 100
+
+	start = appendEscaped(space(hash, domain), params.Start)
+	if len(params.End) > 0 {
+		end = appendEscaped(space(hash, domain), params.End)
 	}
-	if limit > 0 {
-		applyLimit = true
+	if bytes.Compare(start, prefix) < 0 {
+		start = prefix
 	}
+
 	return
 }
 
@@ -264,7 +460,29 @@ type Q struct {
 	Index              string
 	Start, End, Prefix []byte
 	Skip, Limit        int
-	Count              bool
+
+	// Count only counts the results, using a key-only iteration.
+	// Skip is applied, and Limit caps the count, only if provided.
+	Count bool
+
+	// Reverse iterates in descending order, from Start
+	// (inclusive) down to End (exclusive).
+	Reverse bool
+
+	// After is a cursor (Res.Cursor) of a previous query, and the query
+	// continues right after it, instead of Start.
+	After []byte
+
+	// Eq, From and To are used for querying compound indexes.
+	// Eq are the values of leading fields, From (inclusive) and To (exclusive)
+	// are the range of the next field. If any of them are provided,
+	// Start, End and Prefix are ignored.
+	Eq       []interface{}
+	From, To interface{}
+
+	// FetchDocuments loads the documents of the results (Res.Doc),
+	// inside the same transaction.
+	FetchDocuments bool
 }
 
 func (q *Q) init() {
@@ -277,6 +495,32 @@ func (q *Q) init() {
 type Res struct {
 	Key, Val []byte
 	Index    []byte
+
+	// Fields are the decoded fields of a compound index.
+	Fields []interface{}
+
+	// Cursor is an opaque position of this result in the index,
+	// which can be passed as Q.After to get the next page.
+	Cursor []byte
+
+	// Doc is the document of Key, if Q.FetchDocuments is set,
+	// and it is nil if the document does not exist.
+	Doc []byte
+}
+
+// Copy returns a copy of rs, which stays valid after the iteration
+// has moved on (see Scan).
+func (rs Res) Copy() Res {
+	if rs.Val != nil {
+		rs.Val = append([]byte{}, rs.Val...)
+	}
+	if rs.Cursor != nil {
+		rs.Cursor = append([]byte{}, rs.Cursor...)
+	}
+	if rs.Doc != nil {
+		rs.Doc = append([]byte{}, rs.Doc...)
+	}
+	return rs
 }
 
 //-----------------------------------------------------------------------------
@@ -288,4 +532,10 @@ func fnvhash(v []byte) []byte {
 	// return h.Sum(nil)
 }
 
+func fnvhash128(v []byte) []byte {
+	h := fnv.New128a()
+	h.Write(v)
+	return []byte(hex.EncodeToString(h.Sum(nil)))
+}
+
 //-----------------------------------------------------------------------------
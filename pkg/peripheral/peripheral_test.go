@@ -94,15 +94,15 @@ func ExampleNewIndex() {
 		return
 	})
 
-	sampleIndexBuilder := func(txn *layer.Txn, entries map[string][]byte) error {
-		for k, v := range entries {
+	sampleIndexBuilder := func(txn *layer.Txn, changes layer.Changes) error {
+		for _, m := range changes.Latest() {
 			// all indexes must be built here,
-			// based on document type (v), etc, etc.
+			// based on document type (m.Value), etc, etc.
 
-			if err := Emit(txn, indexTags, []byte(k), v); err != nil {
+			if err := Emit(txn, indexTags, m.Key, m.Doc()); err != nil {
 				return err
 			}
-			if err := Emit(txn, indexBy, []byte(k), v); err != nil {
+			if err := Emit(txn, indexBy, m.Key, m.Doc()); err != nil {
 				return err
 			}
 		}
@@ -172,15 +172,15 @@ func ExampleQueryIndex() {
 		return
 	})
 
-	sampleIndexBuilder := func(txn *layer.Txn, entries map[string][]byte) error {
-		for k, v := range entries {
+	sampleIndexBuilder := func(txn *layer.Txn, changes layer.Changes) error {
+		for _, m := range changes.Latest() {
 			// all indexes must be built here,
-			// based on document type (v), etc, etc.
+			// based on document type (m.Value), etc, etc.
 
-			if err := Emit(txn, indexTags, []byte(k), v); err != nil {
+			if err := Emit(txn, indexTags, m.Key, m.Doc()); err != nil {
 				return err
 			}
-			if err := Emit(txn, indexBy, []byte(k), v); err != nil {
+			if err := Emit(txn, indexBy, m.Key, m.Doc()); err != nil {
 				return err
 			}
 		}
@@ -366,15 +366,15 @@ func ExampleQueryIndex_with() {
 		return
 	})
 
-	sampleIndexBuilder := func(txn *layer.Txn, entries map[string][]byte) error {
-		for k, v := range entries {
+	sampleIndexBuilder := func(txn *layer.Txn, changes layer.Changes) error {
+		for _, m := range changes.Latest() {
 			// all indexes must be built here,
-			// based on document type (v), etc, etc.
+			// based on document type (m.Value), etc, etc.
 
-			if err := Emit(txn, indexTags, []byte(k), v); err != nil {
+			if err := Emit(txn, indexTags, m.Key, m.Doc()); err != nil {
 				return err
 			}
-			if err := Emit(txn, indexBy, []byte(k), v); err != nil {
+			if err := Emit(txn, indexBy, m.Key, m.Doc()); err != nil {
 				return err
 			}
 		}
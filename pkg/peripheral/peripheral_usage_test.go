@@ -1,16 +1,25 @@
 package peripheral_test
 
 import (
+	"bytes"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/dc0d/positive/pkg/layer"
 	"github.com/dc0d/positive/pkg/peripheral"
+	"github.com/dc0d/positive/pkg/peripheral/keyenc"
 	"github.com/stretchr/testify/require"
 )
 
@@ -88,17 +97,9 @@ func TestEmit_simple(t *testing.T) {
 		return
 	})
 
-	sampleIndexBuilder := func(txn *layer.Txn, entries map[string][]byte) error {
-		for k, v := range entries {
-			// all indexes must be built here,
-			// based on document type (v), etc, etc.
-
-			if err := peripheral.Emit(txn, indexTags, []byte(k), v); err != nil {
-				return err
-			}
-		}
-		return nil
-	}
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexTags))
+	registry.Attach(db)
 
 	func() {
 		p := &post{
@@ -116,7 +117,7 @@ func TestEmit_simple(t *testing.T) {
 
 		require.NoError(txn.Set([]byte(p.ID), js))
 
-		err = txn.CommitWith(sampleIndexBuilder, nil)
+		err = txn.Commit(nil)
 		require.NoError(err)
 	}()
 
@@ -134,12 +135,12 @@ func TestEmit_simple(t *testing.T) {
 		require.Equal(5, len(got))
 		require.True(got["POST:001"])
 		for k := range got {
-			cond := strings.Contains(k, "<^golang^POST:001") ||
-				strings.Contains(k, "<^nosql^POST:001") ||
-				strings.Contains(k, ">^POST:001^golang") ||
-				strings.Contains(k, ">^POST:001^nosql") ||
-				strings.Contains(k, "POST:001")
-			require.True(cond)
+			cond := strings.HasSuffix(k, "{golang\x00\x01POST:001\x00\x01") ||
+				strings.HasSuffix(k, "{nosql\x00\x01POST:001\x00\x01") ||
+				strings.HasSuffix(k, "}POST:001\x00\x01golang\x00\x01") ||
+				strings.HasSuffix(k, "}POST:001\x00\x01nosql\x00\x01") ||
+				k == "POST:001"
+			require.True(cond, k)
 		}
 	}()
 
@@ -185,3 +186,1596 @@ func TestEmit_simple(t *testing.T) {
 		}
 	}()
 }
+
+func TestRegistry(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	indexBy := peripheral.NewIndex("by", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: val})
+		return
+	})
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexBy))
+	require.Error(registry.Register(indexBy))
+	registry.Attach(db)
+
+	query := func() (res []peripheral.Res) {
+		err := db.View(func(txn *layer.Txn) error {
+			var err error
+			res, _, err = peripheral.QueryIndex(peripheral.Q{Index: "by"}, txn)
+			return err
+		})
+		require.NoError(err)
+		return
+	}
+
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		return txn.Set([]byte("POST:001"), []byte("Frodo"))
+	}))
+	require.NoError(db.UpdateWith(func(txn *layer.Txn) error {
+		return txn.Set([]byte("POST:002"), []byte("Sam"))
+	}, nil))
+
+	res := query()
+	require.Equal(2, len(res))
+	require.Equal("POST:001", string(res[0].Key))
+	require.Equal("Frodo", string(res[0].Index))
+	require.Equal("POST:002", string(res[1].Key))
+	require.Equal("Sam", string(res[1].Index))
+
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		return txn.Delete([]byte("POST:001"))
+	}))
+
+	res = query()
+	require.Equal(1, len(res))
+	require.Equal("POST:002", string(res[0].Key))
+
+	// an empty document is not a delete
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		return txn.Set([]byte("POST:003"), nil)
+	}))
+
+	res = query()
+	require.Equal(2, len(res))
+	require.Equal("POST:003", string(res[0].Key))
+	require.Equal("", string(res[0].Index))
+}
+
+func TestWithKeys(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	var seen []string
+	indexText := peripheral.NewIndex("text", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		seen = append(seen, string(key))
+		entries = append(entries, peripheral.IndexEntry{Index: val})
+		return
+	}, peripheral.WithKeys(peripheral.KeyPrefix("POST:")))
+	indexUser := peripheral.NewIndex("user", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: val})
+		return
+	}, peripheral.WithKeys(peripheral.KeyRegexp(regexp.MustCompile(`^USER:\d+$`))))
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexText, indexUser))
+	registry.Attach(db)
+
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		if err := txn.Set([]byte("POST:001"), []byte("hello")); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("USER:001"), []byte("frodo")); err != nil {
+			return err
+		}
+		return txn.Set([]byte("USER:X"), []byte("sam"))
+	}))
+	require.Equal([]string{"POST:001"}, seen)
+
+	err := db.View(func(txn *layer.Txn) error {
+		res, _, err := peripheral.QueryIndex(peripheral.Q{Index: "text"}, txn)
+		if err != nil {
+			return err
+		}
+		require.Equal(1, len(res))
+		require.Equal("POST:001", string(res[0].Key))
+
+		res, _, err = peripheral.QueryIndex(peripheral.Q{Index: "user"}, txn)
+		if err != nil {
+			return err
+		}
+		require.Equal(1, len(res))
+		require.Equal("USER:001", string(res[0].Key))
+		require.Equal("frodo", string(res[0].Index))
+		return nil
+	})
+	require.NoError(err)
+}
+
+func TestEmit_anyBytes(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	indexVal := peripheral.NewIndex("val", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: val, Val: key})
+		return
+	})
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexVal))
+	registry.Attach(db)
+
+	docs := map[string][]byte{
+		"USER:^frodo^":   []byte("^a^b^"),
+		"USER:\x00\x01":  []byte("a\x00\x01\x00"),
+		"USER:\xff^\x00": []byte("a"),
+		"^user1":         []byte("b"),
+	}
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		for k, v := range docs {
+			if err := txn.Set([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	err := db.View(func(txn *layer.Txn) error {
+		res, _, err := peripheral.QueryIndex(peripheral.Q{Index: "val"}, txn)
+		if err != nil {
+			return err
+		}
+		require.Equal(len(docs), len(res))
+		for _, v := range res {
+			require.Equal(docs[string(v.Key)], v.Index)
+			require.Equal(v.Key, v.Val)
+		}
+
+		res, _, err = peripheral.QueryIndex(peripheral.Q{Index: "val", Prefix: []byte("a")}, txn)
+		if err != nil {
+			return err
+		}
+		require.Equal(2, len(res))
+		require.Equal("a", string(res[0].Index))
+		require.Equal("a\x00\x01\x00", string(res[1].Index))
+
+		res, _, err = peripheral.QueryIndex(peripheral.Q{Index: "val", Prefix: []byte("a")}, txn, true)
+		if err != nil {
+			return err
+		}
+		require.Equal(0, len(res))
+
+		res, _, err = peripheral.QueryIndex(peripheral.Q{Index: "val", Prefix: []byte("USER:^")}, txn, true)
+		if err != nil {
+			return err
+		}
+		require.Equal(1, len(res))
+		require.Equal("USER:^frodo^", string(res[0].Key))
+		require.Equal("^a^b^", string(res[0].Index))
+		return nil
+	})
+	require.NoError(err)
+
+	report, err := peripheral.Verify(db, indexVal)
+	require.NoError(err)
+	require.True(report.OK(), fmt.Sprint(report.Problems))
+	require.Equal(len(docs), report.Checked)
+}
+
+func TestMigrateLegacyLayout(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	indexVal := peripheral.NewIndex("val", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: val})
+		return
+	})
+
+	h := fnv.New64a()
+	h.Write([]byte("val"))
+	hash := hex.EncodeToString(h.Sum(nil))
+	indexOther := peripheral.NewIndex("other", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		return
+	})
+	h = fnv.New64a()
+	h.Write([]byte("other"))
+	hashOther := hex.EncodeToString(h.Sum(nil))
+
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		for _, k := range []string{"K:1", "K:2"} {
+			if err := txn.Set([]byte(k), []byte("V^"+k)); err != nil {
+				return err
+			}
+			x2k := "^" + hash + "<^V^" + k + "^" + k
+			k2x := "^" + hash + ">^" + k + "^V^" + k
+			if err := txn.Set([]byte(k2x), []byte(x2k)); err != nil {
+				return err
+			}
+			if err := txn.Set([]byte(x2k), nil); err != nil {
+				return err
+			}
+		}
+		// an empty document
+		if err := txn.Set([]byte("K:3"), []byte{}); err != nil {
+			return err
+		}
+		// a legacy key of another index, which is not a document
+		return txn.Set([]byte("^"+hashOther+">^K:1^x"), []byte("^"+hashOther+"<^x^K:1"))
+	}))
+
+	require.NoError(peripheral.MigrateLegacyLayout(db, 1, indexVal))
+
+	err := db.View(func(txn *layer.Txn) error {
+		itr := txn.NewIterator(layer.DefaultIteratorOptions)
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			k := string(itr.Item().Key())
+			require.False(strings.HasPrefix(k, "^"+hash+"<^"), k)
+			require.False(strings.HasPrefix(k, "^"+hash+">^"), k)
+		}
+		itr.Close()
+
+		res, _, err := peripheral.QueryIndex(peripheral.Q{Index: "val"}, txn)
+		if err != nil {
+			return err
+		}
+		require.Equal(3, len(res))
+		require.Equal("K:3", string(res[0].Key))
+		require.Equal("", string(res[0].Index))
+		require.Equal("K:1", string(res[1].Key))
+		require.Equal("V^K:1", string(res[1].Index))
+		require.Equal("K:2", string(res[2].Key))
+		require.Equal("V^K:2", string(res[2].Index))
+		return nil
+	})
+	require.NoError(err)
+
+	require.NoError(peripheral.MigrateLegacyLayout(db, 1, indexOther))
+	report, err := peripheral.Verify(db, indexVal, indexOther)
+	require.NoError(err)
+	require.True(report.OK(), fmt.Sprint(report.Problems))
+	require.Equal(3, report.Checked)
+}
+
+func TestQueryIndex_numericRange(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	indexNum := peripheral.NewIndex("num", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		n, err := strconv.ParseInt(string(val), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, peripheral.IndexEntry{Index: keyenc.Int64(n)})
+		return
+	})
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexNum))
+	registry.Attach(db)
+
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		for _, n := range []int{-300, -2, -1, 0, 1, 9, 10, 255, 256, 1000} {
+			if err := txn.Set([]byte(fmt.Sprintf("N:%v", n)), []byte(strconv.Itoa(n))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	err := db.View(func(txn *layer.Txn) error {
+		res, _, err := peripheral.QueryIndex(peripheral.Q{
+			Index: "num",
+			Start: keyenc.Int64(-2),
+			End:   keyenc.Int64(256),
+		}, txn)
+		if err != nil {
+			return err
+		}
+		var got []int64
+		for _, v := range res {
+			n, err := keyenc.DecodeInt64(v.Index)
+			if err != nil {
+				return err
+			}
+			got = append(got, n)
+		}
+		require.Equal([]int64{-2, -1, 0, 1, 9, 10, 255}, got)
+		return nil
+	})
+	require.NoError(err)
+}
+
+func TestQueryIndex_compound(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	type post struct {
+		ID string    `json:"id"`
+		By string    `json:"by,omitempty"`
+		At time.Time `json:"at,omitempty"`
+	}
+
+	indexByAt := peripheral.NewIndex("by_at", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		var p post
+		if err := json.Unmarshal(val, &p); err != nil {
+			return nil, err
+		}
+		entries = append(entries, peripheral.IndexEntry{Fields: []interface{}{p.By, p.At}})
+		return
+	})
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexByAt))
+	registry.Attach(db)
+
+	at := time.Date(2018, 8, 1, 0, 0, 0, 0, time.UTC)
+	posts := []post{
+		{ID: "POST:001", By: "Frodo", At: at.Add(3 * time.Hour)},
+		{ID: "POST:002", By: "Frodo", At: at.Add(1 * time.Hour)},
+		{ID: "POST:003", By: "Frodo", At: at.Add(-24 * time.Hour)},
+		{ID: "POST:004", By: "Frodo Baggins", At: at},
+		{ID: "POST:005", By: "Sam", At: at.Add(2 * time.Hour)},
+	}
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		for _, p := range posts {
+			js, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set([]byte(p.ID), js); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	query := func(q peripheral.Q) (keys []string) {
+		q.Index = "by_at"
+		err := db.View(func(txn *layer.Txn) error {
+			res, _, err := peripheral.QueryIndex(q, txn)
+			if err != nil {
+				return err
+			}
+			for _, v := range res {
+				require.Equal(2, len(v.Fields))
+				keys = append(keys, string(v.Key))
+			}
+			return nil
+		})
+		require.NoError(err)
+		return
+	}
+
+	require.Equal([]string{"POST:003", "POST:002", "POST:001"}, query(peripheral.Q{Eq: []interface{}{"Frodo"}}))
+	require.Equal([]string{"POST:002", "POST:001"}, query(peripheral.Q{Eq: []interface{}{"Frodo"}, From: at}))
+	require.Equal([]string{"POST:003", "POST:002"}, query(peripheral.Q{Eq: []interface{}{"Frodo"}, To: at.Add(3 * time.Hour)}))
+	require.Equal([]string{"POST:004"}, query(peripheral.Q{From: "Frodo Baggins", To: "Sam"}))
+	require.Equal([]string{"POST:005"}, query(peripheral.Q{Eq: []interface{}{"Sam", at.Add(2 * time.Hour)}}))
+}
+
+func TestUnique(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	indexEmail := peripheral.NewIndex("email", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: val})
+		return
+	}, peripheral.Unique())
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexEmail))
+	registry.Attach(db)
+
+	set := func(key, email string) error {
+		return db.Update(func(txn *layer.Txn) error {
+			return txn.Set([]byte(key), []byte(email))
+		})
+	}
+
+	require.NoError(set("USER:1", "frodo@shire"))
+	require.NoError(set("USER:1", "frodo@shire"))
+
+	err := set("USER:2", "frodo@shire")
+	require.Error(err)
+	violation, ok := err.(*peripheral.ErrUniqueViolation)
+	require.True(ok)
+	require.Equal("email", violation.Index)
+	require.Equal("frodo@shire", string(violation.Value))
+	require.Equal("USER:2", string(violation.Key))
+	require.Equal("USER:1", string(violation.Conflict))
+
+	require.NoError(set("USER:1", "frodo@bag-end"))
+	require.NoError(set("USER:2", "frodo@shire"))
+	require.Error(set("USER:3", "frodo@bag-end"))
+
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		return txn.Delete([]byte("USER:1"))
+	}))
+	require.NoError(set("USER:3", "frodo@bag-end"))
+
+	txn1 := db.NewTransaction(true)
+	defer txn1.Discard()
+	txn2 := db.NewTransaction(true)
+	defer txn2.Discard()
+	require.NoError(txn1.Set([]byte("USER:4"), []byte("sam@shire")))
+	require.NoError(txn2.Set([]byte("USER:5"), []byte("sam@shire")))
+	require.NoError(txn1.Commit(nil))
+	require.Equal(layer.ErrConflict, txn2.Commit(nil))
+}
+
+func TestQueryIndex_reverse(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	indexVal := peripheral.NewIndex("val", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: val})
+		return
+	})
+	indexAt := peripheral.NewIndex("at", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Fields: []interface{}{"Frodo", string(val)}})
+		return
+	})
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexVal, indexAt))
+	registry.Attach(db)
+
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		for _, v := range []string{"a", "b", "ba", "c", "d"} {
+			if err := txn.Set([]byte("K:"+v), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	query := func(q peripheral.Q) (vals []string) {
+		err := db.View(func(txn *layer.Txn) error {
+			res, _, err := peripheral.QueryIndex(q, txn)
+			if err != nil {
+				return err
+			}
+			for _, v := range res {
+				vals = append(vals, string(v.Key[2:]))
+			}
+			return nil
+		})
+		require.NoError(err)
+		return
+	}
+
+	require.Equal([]string{"d", "c", "ba", "b", "a"}, query(peripheral.Q{Index: "val", Reverse: true}))
+	require.Equal([]string{"d", "c"}, query(peripheral.Q{Index: "val", Reverse: true, Limit: 2}))
+	require.Equal([]string{"c", "ba", "b"}, query(peripheral.Q{Index: "val", Reverse: true, Start: []byte("c"), End: []byte("a")}))
+	require.Equal([]string{"b", "a"}, query(peripheral.Q{Index: "val", Reverse: true, Start: []byte("b")}))
+	require.Equal([]string{"ba", "b"}, query(peripheral.Q{Index: "val", Reverse: true, Prefix: []byte("b")}))
+	require.Equal([]string{"ba", "b"}, query(peripheral.Q{Index: "val", Reverse: true, Prefix: []byte("b"), Start: []byte("z")}))
+	require.Equal([]string{"b", "ba", "c"}, query(peripheral.Q{Index: "val", Start: []byte("b"), End: []byte("d")}))
+
+	require.Equal([]string{"d", "c", "ba", "b", "a"}, query(peripheral.Q{Index: "at", Reverse: true, Eq: []interface{}{"Frodo"}}))
+	require.Equal([]string{"c", "ba", "b"}, query(peripheral.Q{Index: "at", Reverse: true, Eq: []interface{}{"Frodo"}, From: "b", To: "d"}))
+	require.Equal([]string{"d", "c"}, query(peripheral.Q{Index: "at", Reverse: true, Eq: []interface{}{"Frodo"}, From: "c"}))
+	require.Equal([]string{"b", "a"}, query(peripheral.Q{Index: "at", Reverse: true, Eq: []interface{}{"Frodo"}, To: "ba"}))
+}
+
+func TestQueryIndex_cursor(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	indexVal := peripheral.NewIndex("val", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: val})
+		return
+	})
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexVal))
+	registry.Attach(db)
+
+	var expected []string
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		for i := 0; i < 25; i++ {
+			k := fmt.Sprintf("K:%03d", i)
+			expected = append(expected, k)
+			if err := txn.Set([]byte(k), []byte(fmt.Sprintf("V:%03d", i%7))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	sort.Slice(expected, func(i, j int) bool {
+		a, _ := strconv.Atoi(expected[i][2:])
+		b, _ := strconv.Atoi(expected[j][2:])
+		if a%7 != b%7 {
+			return a%7 < b%7
+		}
+		return a < b
+	})
+
+	page := func(q peripheral.Q) (keys []string) {
+		var after []byte
+		for {
+			q.After = after
+			var res []peripheral.Res
+			err := db.View(func(txn *layer.Txn) error {
+				var err error
+				res, _, err = peripheral.QueryIndex(q, txn)
+				return err
+			})
+			require.NoError(err)
+			for _, v := range res {
+				keys = append(keys, string(v.Key))
+			}
+			if len(res) < q.Limit {
+				return
+			}
+			after = res[len(res)-1].Cursor
+		}
+	}
+
+	require.Equal(expected, page(peripheral.Q{Index: "val", Limit: 4}))
+
+	reversed := page(peripheral.Q{Index: "val", Limit: 3, Reverse: true})
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	require.Equal(expected, reversed)
+
+	err := db.View(func(txn *layer.Txn) error {
+		_, _, err := peripheral.QueryIndex(peripheral.Q{Index: "val", After: []byte("K:001")}, txn)
+		return err
+	})
+	require.Equal(peripheral.ErrInvalidCursor, err)
+}
+
+func TestScan(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	indexVal := peripheral.NewIndex("val", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: val, Val: key})
+		return
+	})
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexVal))
+	registry.Attach(db)
+
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		for i := 0; i < 150; i++ {
+			if err := txn.Set([]byte(fmt.Sprintf("K:%03d", i)), []byte(fmt.Sprintf("V:%03d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	err := db.View(func(txn *layer.Txn) error {
+		cnt := 0
+		err := peripheral.Scan(txn, peripheral.Q{Index: "val"}, func(rs peripheral.Res) (bool, error) {
+			require.Equal(fmt.Sprintf("K:%03d", cnt), string(rs.Key))
+			require.Equal(rs.Key, rs.Val)
+			cnt++
+			return false, nil
+		})
+		if err != nil {
+			return err
+		}
+		require.Equal(150, cnt)
+
+		var kept []peripheral.Res
+		err = peripheral.Scan(txn, peripheral.Q{Index: "val", Skip: 10}, func(rs peripheral.Res) (bool, error) {
+			kept = append(kept, rs.Copy())
+			return len(kept) == 3, nil
+		})
+		if err != nil {
+			return err
+		}
+		require.Equal(3, len(kept))
+		for i, v := range kept {
+			require.Equal(fmt.Sprintf("K:%03d", i+10), string(v.Val))
+		}
+
+		stop := fmt.Errorf("stop")
+		err = peripheral.Scan(txn, peripheral.Q{Index: "val"}, func(rs peripheral.Res) (bool, error) {
+			return false, stop
+		})
+		require.Equal(stop, err)
+		return nil
+	})
+	require.NoError(err)
+}
+
+func TestQueryIndex_fetchDocuments(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	indexVal := peripheral.NewIndex("val", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		if len(val) == 0 {
+			val = []byte("-")
+		}
+		entries = append(entries, peripheral.IndexEntry{Index: val[:1]})
+		return
+	})
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexVal))
+	registry.Attach(db)
+
+	docs := map[string]string{"K:1": "c-one", "K:2": "b-two", "K:3": "a-three", "K:4": ""}
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		for k, v := range docs {
+			if err := txn.Set([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	err := db.View(func(txn *layer.Txn) error {
+		res, _, err := peripheral.QueryIndex(peripheral.Q{Index: "val", FetchDocuments: true}, txn)
+		if err != nil {
+			return err
+		}
+		require.Equal(4, len(res))
+		require.Equal("K:4", string(res[0].Key))
+		require.Equal("K:3", string(res[1].Key))
+		for _, v := range res {
+			require.NotNil(v.Doc)
+			require.Equal(docs[string(v.Key)], string(v.Doc))
+		}
+
+		cnt := 0
+		err = peripheral.Scan(txn, peripheral.Q{Index: "val", FetchDocuments: true}, func(rs peripheral.Res) (bool, error) {
+			require.NotNil(rs.Doc)
+			require.Equal(docs[string(rs.Key)], string(rs.Doc))
+			cnt++
+			return false, nil
+		})
+		require.Equal(4, cnt)
+		return err
+	})
+	require.NoError(err)
+}
+
+func TestQueryIndex_count(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	indexVal := peripheral.NewIndex("val", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: val})
+		return
+	})
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexVal))
+	registry.Attach(db)
+
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		for i := 0; i < 250; i++ {
+			if err := txn.Set([]byte(fmt.Sprintf("K:%03d", i)), []byte(fmt.Sprintf("V:%03d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	count := func(q peripheral.Q) int {
+		q.Index = "val"
+		q.Count = true
+		var cnt int
+		err := db.View(func(txn *layer.Txn) error {
+			res, c, err := peripheral.QueryIndex(q, txn)
+			require.Equal(0, len(res))
+			cnt = c
+			return err
+		})
+		require.NoError(err)
+		return cnt
+	}
+
+	require.Equal(250, count(peripheral.Q{}))
+	require.Equal(10, count(peripheral.Q{Start: []byte("V:010"), End: []byte("V:020")}))
+	require.Equal(10, count(peripheral.Q{Prefix: []byte("V:10")}))
+	require.Equal(5, count(peripheral.Q{Prefix: []byte("V:10"), Skip: 5}))
+	require.Equal(3, count(peripheral.Q{Prefix: []byte("V:10"), Limit: 3}))
+	require.Equal(10, count(peripheral.Q{Start: []byte("V:020"), End: []byte("V:010"), Reverse: true}))
+	require.Equal(0, count(peripheral.Q{Prefix: []byte("X")}))
+}
+
+func TestFind(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	type post struct {
+		ID   string   `json:"id"`
+		By   string   `json:"by,omitempty"`
+		Tags []string `json:"tags,omitempty"`
+	}
+
+	indexTags := peripheral.NewIndex("tags", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		var p post
+		if err := json.Unmarshal(val, &p); err != nil {
+			return nil, err
+		}
+		for _, v := range p.Tags {
+			entries = append(entries, peripheral.IndexEntry{Fields: []interface{}{v}})
+		}
+		return
+	})
+	indexBy := peripheral.NewIndex("by", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		var p post
+		if err := json.Unmarshal(val, &p); err != nil {
+			return nil, err
+		}
+		entries = append(entries, peripheral.IndexEntry{Index: []byte(p.By)})
+		return
+	})
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexTags, indexBy))
+	registry.Attach(db)
+
+	posts := []post{
+		{ID: "POST:001", By: "frodo", Tags: []string{"golang", "nosql"}},
+		{ID: "POST:002", By: "frodo", Tags: []string{"golang"}},
+		{ID: "POST:003", By: "sam", Tags: []string{"golang", "nosql"}},
+		{ID: "POST:004", By: "sam", Tags: []string{"cooking"}},
+		{ID: "POST:005", By: "pippin", Tags: []string{"nosql"}},
+	}
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		for _, p := range posts {
+			js, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set([]byte(p.ID), js); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	tag := func(v string) peripheral.Expr {
+		return peripheral.Match(peripheral.Q{Index: "tags", Eq: []interface{}{v}})
+	}
+	by := func(v string) peripheral.Expr {
+		return peripheral.Match(peripheral.Q{Index: "by", Start: []byte(v), End: []byte(v + "\x00")})
+	}
+	find := func(expr peripheral.Expr) (keys []string) {
+		err := db.View(func(txn *layer.Txn) error {
+			res, err := peripheral.Find(txn, expr)
+			for _, v := range res {
+				keys = append(keys, string(v))
+			}
+			return err
+		})
+		require.NoError(err)
+		return
+	}
+
+	require.Equal([]string{"POST:001", "POST:002"}, find(peripheral.And(tag("golang"), by("frodo"))))
+	require.Equal([]string{"POST:001", "POST:002", "POST:003", "POST:004"}, find(peripheral.Or(tag("golang"), tag("cooking"))))
+	require.Equal([]string{"POST:002"}, find(peripheral.And(tag("golang"), peripheral.Not(tag("nosql")))))
+	require.Equal([]string{"POST:003", "POST:005"}, find(peripheral.And(
+		peripheral.Or(tag("nosql"), tag("cooking")),
+		peripheral.Not(by("frodo")),
+		peripheral.Not(tag("cooking")),
+	)))
+	require.Equal([]string{"POST:001", "POST:002", "POST:003", "POST:004", "POST:005"},
+		find(peripheral.Match(peripheral.Q{Index: "tags"})))
+	require.Nil(find(peripheral.And(tag("cooking"), by("frodo"))))
+
+	// range matches are sorted, before they are merged
+	byRange := peripheral.Match(peripheral.Q{Index: "by", Start: []byte("pippin"), End: []byte("sam\x00")})
+	require.Equal([]string{"POST:003", "POST:004", "POST:005"}, find(byRange))
+	require.Equal([]string{"POST:003", "POST:005"}, find(peripheral.And(byRange, tag("nosql"))))
+	require.Equal([]string{"POST:001", "POST:003", "POST:004", "POST:005"},
+		find(peripheral.Or(tag("nosql"), byRange)))
+	require.Equal([]string{"POST:004"}, find(peripheral.And(byRange, peripheral.Not(tag("nosql")))))
+
+	var streamed []string
+	err := db.View(func(txn *layer.Txn) error {
+		return peripheral.FindFunc(txn, peripheral.Or(tag("golang"), tag("nosql")), func(key []byte) (bool, error) {
+			streamed = append(streamed, string(key))
+			return len(streamed) == 2, nil
+		})
+	})
+	require.NoError(err)
+	require.Equal([]string{"POST:001", "POST:002"}, streamed)
+
+	err = db.View(func(txn *layer.Txn) error {
+		_, err := peripheral.Find(txn, peripheral.Not(tag("golang")))
+		return err
+	})
+	require.Equal(peripheral.ErrUnboundedNot, err)
+
+	err = db.View(func(txn *layer.Txn) error {
+		_, err := peripheral.Find(txn, peripheral.And(tag("golang"), peripheral.Or()))
+		return err
+	})
+	require.Equal(peripheral.ErrEmptyExpr, err)
+}
+
+func TestFind_batches(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	indexMod := peripheral.NewIndex("mod", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		n, err := strconv.Atoi(string(val))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range []int{2, 3} {
+			if n%m == 0 {
+				entries = append(entries, peripheral.IndexEntry{Fields: []interface{}{int64(m)}})
+			}
+		}
+		return
+	})
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexMod))
+	registry.Attach(db)
+
+	const count = 1000
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		for i := 0; i < count; i++ {
+			if err := txn.Set([]byte(fmt.Sprintf("N:%04d", i)), []byte(strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	mod := func(m int64) peripheral.Expr {
+		return peripheral.Match(peripheral.Q{Index: "mod", Eq: []interface{}{m}})
+	}
+	var and, or, not int
+	err := db.View(func(txn *layer.Txn) error {
+		counter := func(n *int) func([]byte) (bool, error) {
+			return func([]byte) (bool, error) {
+				*n++
+				return false, nil
+			}
+		}
+		if err := peripheral.FindFunc(txn, peripheral.And(mod(2), mod(3)), counter(&and)); err != nil {
+			return err
+		}
+		if err := peripheral.FindFunc(txn, peripheral.Or(mod(2), mod(3)), counter(&or)); err != nil {
+			return err
+		}
+		return peripheral.FindFunc(txn, peripheral.And(mod(2), peripheral.Not(mod(3))), counter(&not))
+	})
+	require.NoError(err)
+	require.Equal(167, and)
+	require.Equal(667, or)
+	require.Equal(333, not)
+}
+
+func TestWhere(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	type post struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+		Title  string `json:"title"`
+	}
+
+	calls := 0
+	indexPublished := peripheral.NewIndex("published", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		calls++
+		var p post
+		if err := json.Unmarshal(val, &p); err != nil {
+			return nil, err
+		}
+		entries = append(entries, peripheral.IndexEntry{Index: []byte(p.Title)})
+		return
+	}, peripheral.Where(func(key, val []byte) bool {
+		return bytes.Contains(val, []byte(`"status":"published"`))
+	}))
+	require.True(indexPublished.Partial())
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexPublished))
+	registry.Attach(db)
+	require.NoError(peripheral.DefineIndex(db, indexPublished))
+
+	save := func(p post) {
+		js, err := json.Marshal(p)
+		require.NoError(err)
+		require.NoError(db.Update(func(txn *layer.Txn) error {
+			return txn.Set([]byte(p.ID), js)
+		}))
+	}
+	published := func() (keys []string) {
+		err := db.View(func(txn *layer.Txn) error {
+			info, err := peripheral.GetIndexInfo(txn, "published")
+			if err != nil {
+				return err
+			}
+			require.True(info.Partial)
+			res, _, err := peripheral.QueryIndex(peripheral.Q{Index: "published"}, txn)
+			for _, v := range res {
+				keys = append(keys, string(v.Key))
+			}
+			return err
+		})
+		require.NoError(err)
+		return
+	}
+
+	save(post{ID: "POST:001", Status: "draft", Title: "a"})
+	save(post{ID: "POST:002", Status: "published", Title: "b"})
+	require.Equal(1, calls)
+	require.Equal([]string{"POST:002"}, published())
+
+	save(post{ID: "POST:001", Status: "published", Title: "a"})
+	require.Equal([]string{"POST:001", "POST:002"}, published())
+
+	save(post{ID: "POST:002", Status: "draft", Title: "b"})
+	require.Equal([]string{"POST:001"}, published())
+	require.Equal(2, calls)
+
+	err := db.View(func(txn *layer.Txn) error {
+		_, err := peripheral.GetIndexInfo(txn, "unknown")
+		return err
+	})
+	require.Equal(layer.ErrKeyNotFound, err)
+}
+
+func TestProject(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	type post struct {
+		ID    string    `json:"id"`
+		By    string    `json:"by"`
+		Title string    `json:"title"`
+		Text  string    `json:"text"`
+		At    time.Time `json:"at"`
+	}
+
+	indexBy := peripheral.NewIndex("by", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		var p post
+		if err := json.Unmarshal(val, &p); err != nil {
+			return nil, err
+		}
+		entries = append(entries, peripheral.IndexEntry{Index: []byte(p.By)})
+		return
+	}, peripheral.Project("title", "at"))
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexBy))
+	registry.Attach(db)
+	require.NoError(peripheral.DefineIndex(db, indexBy))
+
+	at := time.Date(2018, 8, 1, 0, 0, 0, 0, time.UTC)
+	p := post{ID: "POST:001", By: "frodo", Title: "There and back", Text: "long text", At: at}
+	js, err := json.Marshal(p)
+	require.NoError(err)
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		return txn.Set([]byte(p.ID), js)
+	}))
+
+	err = db.View(func(txn *layer.Txn) error {
+		info, err := peripheral.GetIndexInfo(txn, "by")
+		if err != nil {
+			return err
+		}
+		require.Equal([]string{"title", "at"}, info.Projection)
+
+		res, _, err := peripheral.QueryIndex(peripheral.Q{Index: "by"}, txn)
+		if err != nil {
+			return err
+		}
+		require.Equal(1, len(res))
+		var item post
+		require.NoError(res[0].Projection(&item))
+		require.Equal(post{Title: p.Title, At: at}, item)
+		return nil
+	})
+	require.NoError(err)
+}
+
+func TestVerify(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	indexBy := peripheral.NewIndex("by", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: val})
+		return
+	}, peripheral.Unique())
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexBy))
+	registry.Attach(db)
+
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		for i, by := range []string{"frodo", "sam", "merry"} {
+			if err := txn.Set([]byte(fmt.Sprintf("POST:%03d", i)), []byte(by)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	report, err := peripheral.Verify(db, indexBy)
+	require.NoError(err)
+	require.True(report.OK())
+	require.Equal(3, report.Checked)
+
+	// writes skipping the commit hooks
+	raw := func(fn func(txn *layer.Txn) error) {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.NoError(fn(txn))
+		require.NoError(txn.Txn.Commit(nil))
+	}
+	raw(func(txn *layer.Txn) error { return txn.Set([]byte("POST:003"), []byte("pippin")) })
+	raw(func(txn *layer.Txn) error { return txn.Set([]byte("POST:001"), []byte("gandalf")) })
+	raw(func(txn *layer.Txn) error { return txn.Delete([]byte("POST:002")) })
+	// the unique guard of POST:000 is the only index key with the value POST:000
+	raw(func(txn *layer.Txn) error {
+		itr := txn.NewIterator(layer.DefaultIteratorOptions)
+		defer itr.Close()
+		prefix := []byte("^")
+		for itr.Seek(prefix); itr.ValidForPrefix(prefix); itr.Next() {
+			v, err := itr.Item().Value()
+			if err != nil {
+				return err
+			}
+			if string(v) == "POST:000" {
+				return txn.Delete(itr.Item().KeyCopy(nil))
+			}
+		}
+		return errors.New("guard not found")
+	})
+
+	report, err = peripheral.Verify(db, indexBy)
+	require.NoError(err)
+	require.False(report.OK())
+	kinds := make(map[string][]peripheral.ProblemKind)
+	for _, p := range report.Problems {
+		kinds[string(p.Key)] = append(kinds[string(p.Key)], p.Kind)
+	}
+	require.Equal(map[string][]peripheral.ProblemKind{
+		"POST:000": {peripheral.Missing},
+		"POST:003": {peripheral.Missing, peripheral.Missing},
+		"POST:001": {peripheral.Missing, peripheral.Missing, peripheral.Stale},
+		"POST:002": {peripheral.Orphaned, peripheral.Orphaned, peripheral.Orphaned},
+	}, kinds)
+
+	require.NoError(peripheral.Repair(db, report, 2))
+
+	report, err = peripheral.Verify(db, indexBy)
+	require.NoError(err)
+	require.True(report.OK(), fmt.Sprint(report.Problems))
+
+	err = db.View(func(txn *layer.Txn) error {
+		res, _, err := peripheral.QueryIndex(peripheral.Q{Index: "by"}, txn)
+		if err != nil {
+			return err
+		}
+		var got []string
+		for _, v := range res {
+			got = append(got, string(v.Index)+"="+string(v.Key))
+		}
+		require.Equal([]string{"frodo=POST:000", "gandalf=POST:001", "pippin=POST:003"}, got)
+		return nil
+	})
+	require.NoError(err)
+}
+
+func TestDropIndex(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	indexBy := peripheral.NewIndex("by", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: val})
+		return
+	}, peripheral.Unique())
+	indexLen := peripheral.NewIndex("len", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: []byte(strconv.Itoa(len(val)))})
+		return
+	})
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexBy, indexLen))
+	registry.Attach(db)
+	require.NoError(peripheral.DefineIndex(db, indexBy))
+
+	const count = 2500
+	for i := 0; i < count; i += 500 {
+		require.NoError(db.Update(func(txn *layer.Txn) error {
+			for j := i; j < i+500; j++ {
+				if err := txn.Set([]byte(fmt.Sprintf("POST:%05d", j)), []byte(fmt.Sprintf("BY:%05d", j))); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+
+	// documents with keys starting with the hash of the index
+	h := fnv.New64a()
+	h.Write([]byte("by"))
+	hash := hex.EncodeToString(h.Sum(nil))
+	docs := []string{"^" + hash, "^" + hash + "x", "^" + hash + "user"}
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		for _, k := range docs {
+			if err := txn.Set([]byte(k), []byte("BY:"+k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	registry.Unregister("by")
+	var calls, deleted int
+	require.NoError(peripheral.DropIndex(db, "by", func(n int) {
+		calls++
+		deleted = n
+	}))
+	// K2X, X2K and unique guard keys
+	require.Equal(3*(count+len(docs)), deleted)
+	require.True(calls > 1)
+
+	// dropping again is a no-op
+	calls = 0
+	require.NoError(peripheral.DropIndex(db, "by", func(int) { calls++ }))
+	require.Equal(0, calls)
+
+	err := db.View(func(txn *layer.Txn) error {
+		_, err := peripheral.GetIndexInfo(txn, "by")
+		require.Equal(layer.ErrKeyNotFound, err)
+
+		_, n, err := peripheral.QueryIndex(peripheral.Q{Index: "by", Count: true}, txn)
+		require.NoError(err)
+		require.Equal(0, n)
+
+		_, n, err = peripheral.QueryIndex(peripheral.Q{Index: "len", Count: true}, txn)
+		require.NoError(err)
+		require.Equal(count+len(docs), n)
+
+		for _, k := range docs {
+			item, err := txn.Get([]byte(k))
+			require.NoError(err, k)
+			v, err := item.Value()
+			require.NoError(err)
+			require.Equal("BY:"+k, string(v))
+		}
+		return nil
+	})
+	require.NoError(err)
+}
+
+func TestCatalog(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	indexFn := func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: val})
+		return
+	}
+	indexBy := peripheral.NewIndex("by", indexFn, peripheral.Unique())
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexBy))
+	registry.Attach(db)
+
+	// no documents, so there is nothing to build
+	require.NoError(peripheral.DefineIndex(db, indexBy))
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		return txn.Set([]byte("POST:001"), []byte("frodo"))
+	}))
+
+	indexLen := peripheral.NewIndex("len", indexFn)
+	require.NoError(peripheral.DefineIndex(db, indexLen))
+
+	query := func(name string) (err error) {
+		db.View(func(txn *layer.Txn) error {
+			_, _, err = peripheral.QueryIndex(peripheral.Q{Index: name}, txn)
+			return nil
+		})
+		return
+	}
+
+	err := db.View(func(txn *layer.Txn) error {
+		list, err := peripheral.ListIndexes(txn)
+		if err != nil {
+			return err
+		}
+		require.Equal(2, len(list))
+		require.Equal("by", list[0].Name)
+		require.Equal(peripheral.Ready, list[0].State)
+		require.True(list[0].Unique)
+		require.False(list[0].ReadyAt.IsZero())
+		require.Equal("len", list[1].Name)
+		require.Equal(peripheral.Building, list[1].State)
+		return nil
+	})
+	require.NoError(err)
+
+	require.NoError(query("by"))
+	require.True(errors.Is(query("len"), peripheral.ErrIndexBuilding))
+
+	require.NoError(peripheral.SetIndexState(db, "len", peripheral.Ready))
+	require.NoError(query("len"))
+
+	// defining again keeps the state, a new version needs building
+	require.NoError(peripheral.DefineIndex(db, indexLen))
+	require.NoError(query("len"))
+	require.NoError(peripheral.DefineIndex(db, peripheral.NewIndex("len", indexFn, peripheral.Version(2))))
+	require.True(errors.Is(query("len"), peripheral.ErrIndexBuilding))
+
+	require.Equal(layer.ErrKeyNotFound, peripheral.SetIndexState(db, "none", peripheral.Ready))
+}
+
+func TestHashCollision(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	indexFn := func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: val})
+		return
+	}
+	indexBy := peripheral.NewIndex("by", indexFn, peripheral.ID(1))
+	indexAuthor := peripheral.NewIndex("author", indexFn, peripheral.ID(1))
+	indexTitle := peripheral.NewIndex("title", indexFn, peripheral.LongHash())
+
+	registry := peripheral.NewRegistry()
+	require.True(errors.Is(registry.Register(indexBy, indexAuthor), peripheral.ErrHashCollision))
+	registry.Unregister("by")
+	require.NoError(registry.Register(indexBy, indexTitle))
+	registry.Attach(db)
+
+	require.NoError(peripheral.DefineIndex(db, indexBy))
+	require.NoError(peripheral.DefineIndex(db, indexTitle))
+	require.True(errors.Is(peripheral.DefineIndex(db, indexAuthor), peripheral.ErrHashCollision))
+
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		return txn.Set([]byte("POST:001"), []byte("frodo"))
+	}))
+
+	err := db.View(func(txn *layer.Txn) error {
+		for _, name := range []string{"by", "title"} {
+			info, err := peripheral.GetIndexInfo(txn, name)
+			if err != nil {
+				return err
+			}
+			require.NotEqual(16, len(info.Hash))
+
+			res, _, err := peripheral.QueryIndex(peripheral.Q{Index: name}, txn)
+			if err != nil {
+				return err
+			}
+			require.Equal(1, len(res))
+			require.Equal("POST:001", string(res[0].Key))
+		}
+		return nil
+	})
+	require.NoError(err)
+
+	// indexes with an ID must be defined, before they are emitted
+	indexTags := peripheral.NewIndex("tags", indexFn, peripheral.ID(2))
+	require.NoError(registry.Register(indexTags))
+	set := func() error {
+		return db.Update(func(txn *layer.Txn) error {
+			return txn.Set([]byte("POST:002"), []byte("sam"))
+		})
+	}
+	require.True(errors.Is(set(), peripheral.ErrIndexNotDefined))
+	require.NoError(peripheral.DefineIndex(db, indexTags))
+	require.NoError(set())
+
+	// the hash of a defined index can not change
+	indexBy2 := peripheral.NewIndex("by", indexFn, peripheral.ID(3))
+	require.True(errors.Is(peripheral.DefineIndex(db, indexBy2), peripheral.ErrIndexHashChanged))
+	registry.Unregister("by")
+	require.NoError(registry.Register(indexBy2))
+	require.True(errors.Is(set(), peripheral.ErrIndexHashChanged))
+	registry.Unregister("by")
+	require.NoError(peripheral.DropIndex(db, "by"))
+	require.NoError(peripheral.DefineIndex(db, indexBy2))
+	require.NoError(registry.Register(indexBy2))
+	require.NoError(set())
+}
+
+func TestEmitDiff(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+	db.EnablePreImages()
+
+	indexTags := peripheral.NewIndex("tags", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		for _, tag := range strings.Fields(string(val)) {
+			entries = append(entries, peripheral.IndexEntry{Index: []byte(tag), Val: []byte(strconv.Itoa(len(val)))})
+		}
+		return
+	})
+	indexFirst := peripheral.NewIndex("first", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		if tags := strings.Fields(string(val)); len(tags) > 0 {
+			entries = append(entries, peripheral.IndexEntry{Index: []byte(tags[0])})
+		}
+		return
+	}, peripheral.Unique())
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexTags, indexFirst))
+	registry.Attach(db)
+
+	set := func(key, val string) error {
+		return db.Update(func(txn *layer.Txn) error {
+			if val == "" {
+				return txn.Delete([]byte(key))
+			}
+			return txn.Set([]byte(key), []byte(val))
+		})
+	}
+	verify := func() {
+		report, err := peripheral.Verify(db, indexTags, indexFirst)
+		require.NoError(err)
+		require.True(report.OK(), fmt.Sprint(report.Problems))
+	}
+
+	require.NoError(set("POST:001", "go db"))
+	require.NoError(set("POST:002", "db kv"))
+	verify()
+	require.NoError(set("POST:001", "go kv index"))
+	verify()
+	require.NoError(set("POST:002", "index"))
+	verify()
+
+	var violation *peripheral.ErrUniqueViolation
+	require.True(errors.As(set("POST:003", "go"), &violation))
+	require.Equal("POST:001", string(violation.Conflict))
+
+	require.NoError(set("POST:001", ""))
+	verify()
+	require.NoError(set("POST:003", "go"))
+	verify()
+
+	err := db.View(func(txn *layer.Txn) error {
+		res, _, err := peripheral.QueryIndex(peripheral.Q{Index: "tags"}, txn)
+		if err != nil {
+			return err
+		}
+		var got []string
+		for _, v := range res {
+			got = append(got, string(v.Index)+"="+string(v.Key))
+		}
+		require.Equal([]string{"go=POST:003", "index=POST:002"}, got)
+		return nil
+	})
+	require.NoError(err)
+}
+
+func BenchmarkEmit(b *testing.B) {
+	indexFn := func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		for _, tag := range strings.Fields(string(val)) {
+			entries = append(entries, peripheral.IndexEntry{Index: []byte(tag)})
+		}
+		return
+	}
+
+	run := func(b *testing.B, preImages bool) {
+		db := createDB("", false)
+		defer db.Close()
+		if preImages {
+			db.EnablePreImages()
+		}
+
+		registry := peripheral.NewRegistry()
+		for i := 0; i < 5; i++ {
+			if err := registry.Register(peripheral.NewIndex(fmt.Sprintf("ix%d", i), indexFn)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		registry.Attach(db)
+
+		const docs = 100
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			err := db.Update(func(txn *layer.Txn) error {
+				key := []byte(fmt.Sprintf("POST:%05d", i%docs))
+				return txn.Set(key, []byte(fmt.Sprintf("golang nosql badger tag%d", i%7)))
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("scan", func(b *testing.B) { run(b, false) })
+	b.Run("pre-images", func(b *testing.B) { run(b, true) })
+}
+
+func TestRegistry_managedDB(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "database")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	var opts = layer.DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+	db, err := layer.OpenManaged(opts)
+	require.NoError(err)
+	defer db.Close()
+
+	indexBy := peripheral.NewIndex("by", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: val})
+		return
+	})
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexBy))
+	registry.Attach(db)
+
+	require.NoError(db.UpdateAt(1, 2, func(txn *layer.Txn) error {
+		return txn.Set([]byte("POST:001"), []byte("frodo"))
+	}))
+	require.NoError(db.UpdateAt(2, 3, func(txn *layer.Txn) error {
+		return txn.Set([]byte("POST:001"), []byte("sam"))
+	}))
+
+	query := func(readTs uint64) (res []string) {
+		require.NoError(db.ViewAt(readTs, func(txn *layer.Txn) error {
+			list, _, err := peripheral.QueryIndex(peripheral.Q{Index: "by"}, txn)
+			for _, v := range list {
+				res = append(res, string(v.Index)+"="+string(v.Key))
+			}
+			return err
+		}))
+		return
+	}
+	require.Equal([]string{"frodo=POST:001"}, query(2))
+	require.Equal([]string{"sam=POST:001"}, query(3))
+}
+
+func TestUnique_swap(t *testing.T) {
+	for _, preImages := range []bool{false, true} {
+		t.Run(fmt.Sprint("preImages=", preImages), func(t *testing.T) {
+			require := require.New(t)
+
+			db := createDB("", false)
+			defer db.Close()
+			if preImages {
+				db.EnablePreImages()
+			}
+
+			indexEmail := peripheral.NewIndex("email", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+				entries = append(entries, peripheral.IndexEntry{Index: val})
+				return
+			}, peripheral.Unique())
+
+			registry := peripheral.NewRegistry()
+			require.NoError(registry.Register(indexEmail))
+			registry.Attach(db)
+
+			require.NoError(db.Update(func(txn *layer.Txn) error {
+				if err := txn.Set([]byte("U:1"), []byte("a")); err != nil {
+					return err
+				}
+				return txn.Set([]byte("U:2"), []byte("b"))
+			}))
+			require.NoError(db.Update(func(txn *layer.Txn) error {
+				if err := txn.Set([]byte("U:1"), []byte("b")); err != nil {
+					return err
+				}
+				return txn.Set([]byte("U:2"), []byte("c"))
+			}))
+
+			report, err := peripheral.Verify(db, indexEmail)
+			require.NoError(err)
+			require.Empty(report.Problems)
+
+			require.NoError(db.View(func(txn *layer.Txn) error {
+				for email, key := range map[string]string{"b": "U:1", "c": "U:2"} {
+					var keys []string
+					err := peripheral.Scan(txn, peripheral.Q{Index: "email", Start: []byte(email), Prefix: []byte(email)}, func(r peripheral.Res) (bool, error) {
+						keys = append(keys, string(r.Key))
+						return false, nil
+					})
+					if err != nil {
+						return err
+					}
+					require.Equal([]string{key}, keys)
+				}
+				return nil
+			}))
+			require.NoError(db.Update(func(txn *layer.Txn) error {
+				return txn.Set([]byte("U:3"), []byte("a"))
+			}))
+			require.Error(db.Update(func(txn *layer.Txn) error {
+				return txn.Set([]byte("U:4"), []byte("b"))
+			}))
+		})
+	}
+}
+
+func TestWhere_preImages(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+	db.EnablePreImages()
+
+	calls, preds := 0, 0
+	indexPublished := peripheral.NewIndex("published", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		calls++
+		entries = append(entries, peripheral.IndexEntry{Index: key})
+		return
+	}, peripheral.Where(func(key, val []byte) bool {
+		preds++
+		return bytes.HasPrefix(val, []byte("published"))
+	}))
+
+	registry := peripheral.NewRegistry()
+	require.NoError(registry.Register(indexPublished))
+	registry.Attach(db)
+
+	save := func(key, val string) {
+		require.NoError(db.Update(func(txn *layer.Txn) error {
+			return txn.Set([]byte(key), []byte(val))
+		}))
+	}
+
+	save("POST:001", "draft 1")
+	save("POST:001", "draft 2")
+	save("POST:001", "draft 3")
+	require.Equal(0, calls)
+	require.Equal(5, preds)
+
+	save("POST:001", "published")
+	require.Equal(1, calls)
+	save("POST:001", "draft 4")
+	require.Equal(2, calls)
+
+	report, err := peripheral.Verify(db, indexPublished)
+	require.NoError(err)
+	require.Empty(report.Problems)
+}
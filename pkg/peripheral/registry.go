@@ -0,0 +1,137 @@
+package peripheral
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/dc0d/positive/pkg/layer"
+)
+
+//-----------------------------------------------------------------------------
+
+// error
+var (
+	ErrDuplicateIndex = fmt.Errorf("duplicate index")
+	ErrHashCollision  = fmt.Errorf("index hash collision")
+)
+
+// Registry holds a set of indexes, which are emitted together
+// for every written key.
+type Registry struct {
+	mx      sync.RWMutex
+	indexes []*Index
+}
+
+// NewRegistry .
+func NewRegistry() *Registry { return &Registry{} }
+
+// Register adds indexes to the registry. Indexes with the same name
+// or the same hash (see ID and LongHash) are refused - DefineIndex checks
+// for collisions with the defined indexes.
+func (r *Registry) Register(indexes ...*Index) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for _, ix := range indexes {
+		if ix == nil {
+			panic("index must be provided")
+		}
+		for _, v := range r.indexes {
+			if v.name == ix.name {
+				return fmt.Errorf("%w: %v", ErrDuplicateIndex, ix.name)
+			}
+			if v.hash == ix.hash {
+				return fmt.Errorf("%w: %v and %v", ErrHashCollision, v.name, ix.name)
+			}
+		}
+		r.indexes = append(r.indexes, ix)
+	}
+	return nil
+}
+
+// Unregister removes indexes with provided names from the registry.
+func (r *Registry) Unregister(names ...string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	var rest []*Index
+	for _, ix := range r.indexes {
+		found := false
+		for _, name := range names {
+			if ix.name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			rest = append(rest, ix)
+		}
+	}
+	r.indexes = rest
+}
+
+// Indexes returns registered indexes.
+func (r *Registry) Indexes() []*Index {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	res := make([]*Index, len(r.indexes))
+	copy(res, r.indexes)
+	return res
+}
+
+// BeforeCommit emits all registered indexes for the last change of each key,
+// it is a layer.BeforeCommit. A key set to nil is indexed as an empty
+// document, only deleted keys are removed from indexes.
+//
+// The previous entries of all changed keys are deleted first, and then
+// the new entries are written - so values of unique indexes can move
+// between keys, inside a transaction, in any order.
+//
+// If the previous values are captured (see layer.DB.EnablePreImages),
+// EmitDiff is used instead of Emit.
+//
+// Indexes with an ID or a LongHash must be defined (see DefineIndex),
+// otherwise the commit fails with ErrIndexNotDefined.
+func (r *Registry) BeforeCommit(txn *layer.Txn, changes layer.Changes) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	indexes := r.Indexes()
+	for _, ix := range indexes {
+		if err := checkDefined(txn, ix); err != nil {
+			return err
+		}
+	}
+	var pending []emission
+	for _, m := range changes.Latest() {
+		for _, ix := range indexes {
+			var (
+				em  emission
+				err error
+			)
+			if m.HasPrev {
+				em, err = releaseDiff(txn, ix, m.Key, m.Prev, m.Doc())
+			} else {
+				em, err = release(txn, ix, m.Key, m.Doc())
+			}
+			if err != nil {
+				return err
+			}
+			if len(em.writes) > 0 {
+				pending = append(pending, em)
+			}
+		}
+	}
+	for _, em := range pending {
+		if err := em.write(txn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Attach registers the registry as a before commit hook of db (a layer.DB
+// or a layer.ManagedDB), so all writes through db maintain the registered indexes.
+func (r *Registry) Attach(db interface{ AddBeforeCommit(...layer.BeforeCommit) }) {
+	db.AddBeforeCommit(r.BeforeCommit)
+}
+
+//-----------------------------------------------------------------------------
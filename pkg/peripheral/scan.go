@@ -0,0 +1,191 @@
+package peripheral
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/dc0d/positive/pkg/layer"
+	"github.com/dc0d/positive/pkg/peripheral/keyenc"
+)
+
+//-----------------------------------------------------------------------------
+
+// Scan streams the results of the query to fn, until fn returns stop
+// or an error, or the results are exhausted. Unlike QueryIndex, Limit
+// is not applied if it is not provided.
+//
+// The underlying iterator is reused, so Res.Val and Res.Cursor are only
+// valid during the call to fn - use Res.Copy to keep them.
+func Scan(txn *layer.Txn, params Q, fn func(Res) (stop bool, err error), forIndexedKeys ...bool) error {
+	q, err := newQuery(txn, params, forIndexedKeys...)
+	if err != nil {
+		return err
+	}
+
+	skip, limit := params.Skip, params.Limit
+	return q.iterate(txn, false, func(item *layer.Item) (bool, error) {
+		if skip > 0 {
+			skip--
+			return false, nil
+		}
+		if params.Limit > 0 && limit <= 0 {
+			return true, nil
+		}
+		limit--
+		rs, err := q.decode(item.Key())
+		if err != nil {
+			return false, err
+		}
+		if rs.Val, err = item.Value(); err != nil {
+			return false, err
+		}
+		if params.FetchDocuments {
+			if rs.Doc, err = fetchDocument(txn, rs.Key, false); err != nil {
+				return false, err
+			}
+		}
+		return fn(rs)
+	})
+}
+
+// FetchDocuments loads the documents of reslist (Res.Doc), in the order
+// of their keys, which is the order they are stored in. Each document is
+// read with a point lookup, they are not prefetched.
+func FetchDocuments(txn *layer.Txn, reslist []Res) error {
+	order := make([]int, len(reslist))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(reslist[order[i]].Key, reslist[order[j]].Key) < 0
+	})
+	for _, i := range order {
+		doc, err := fetchDocument(txn, reslist[i].Key, true)
+		if err != nil {
+			return err
+		}
+		reslist[i].Doc = doc
+	}
+	return nil
+}
+
+func fetchDocument(txn *layer.Txn, key []byte, copyValue bool) ([]byte, error) {
+	item, err := txn.Get(key)
+	if err == layer.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var v []byte
+	if copyValue {
+		v, err = item.ValueCopy(nil)
+	} else {
+		v, err = item.Value()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return document(v), nil
+}
+
+// document returns the value of an existing key, as a document -
+// an empty value is an empty document, not a missing one.
+func document(v []byte) []byte {
+	if v == nil {
+		return []byte{}
+	}
+	return v
+}
+
+//-----------------------------------------------------------------------------
+
+// query holds the prepared bounds of a Q.
+type query struct {
+	params             Q
+	hash, domain       string
+	compound           bool
+	start, end, prefix []byte
+}
+
+func newQuery(txn *layer.Txn, params Q, forIndexedKeys ...bool) (q *query, reserr error) {
+	if params.Index == "" {
+		reserr = ErrNoIndexNameProvided
+		return
+	}
+	hash, err := resolveHash(txn, params.Index)
+	if err != nil {
+		reserr = err
+		return
+	}
+	q = &query{
+		hash:     hash,
+		domain:   getdomain(forIndexedKeys...),
+		compound: params.isCompound(),
+	}
+	if q.compound {
+		if reserr = params.compound(); reserr != nil {
+			return
+		}
+	}
+	q.params = params
+	q.start, q.end, q.prefix = stopWords(params, q.hash, q.domain, q.compound)
+	if len(params.After) > 0 {
+		if !bytes.HasPrefix(params.After, space(q.hash, q.domain)) {
+			reserr = ErrInvalidCursor
+			return
+		}
+		q.start = params.After
+	}
+	return
+}
+
+func (q *query) iterate(txn *layer.Txn, keysOnly bool, body func(item *layer.Item) (stop bool, err error)) error {
+	var opt = layer.DefaultIteratorOptions
+	opt.PrefetchValues = !keysOnly
+	if q.params.Limit > 0 {
+		opt.PrefetchSize = q.params.Limit
+	}
+	opt.Reverse = q.params.Reverse
+	return itrFunc(txn, opt, q.start, q.end, q.prefix, len(q.params.After) > 0, body)
+}
+
+// decode creates a Res from an index key, the key itself is not retained.
+func (q *query) decode(k []byte) (rs Res, reserr error) {
+	first, second, err := splitIndexKey(k, q.hash, q.domain)
+	if err != nil {
+		reserr = err
+		return
+	}
+	rs.Index, rs.Key = first, second
+	if q.domain == indexK2X {
+		rs.Index, rs.Key = second, first
+	}
+	rs.Cursor = k
+	if q.compound {
+		rs.Fields, reserr = keyenc.DecodeTuple(rs.Index)
+	}
+	return
+}
+
+// countIndex counts the index keys, between the bounds of the query,
+// without reading the values.
+func countIndex(params Q, txn *layer.Txn, forIndexedKeys ...bool) (count int, reserr error) {
+	q, err := newQuery(txn, params, forIndexedKeys...)
+	if err != nil {
+		reserr = err
+		return
+	}
+	skip := params.Skip
+	reserr = q.iterate(txn, true, func(*layer.Item) (bool, error) {
+		if skip > 0 {
+			skip--
+			return false, nil
+		}
+		count++
+		return params.Limit > 0 && count >= params.Limit, nil
+	})
+	return
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,80 @@
+package peripheral
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/dc0d/positive/pkg/layer"
+)
+
+//-----------------------------------------------------------------------------
+
+// Unique makes the index to accept each index value for only one key.
+// Emitting an index value which is already owned by another key
+// fails with *ErrUniqueViolation.
+//
+// Each index value of a unique index has a guard key, which is read and
+// written inside the transaction - so badger's conflict detection makes
+// concurrent writers of the same value fail with layer.ErrConflict.
+func Unique() IndexOption {
+	return func(ix *Index) { ix.unique = true }
+}
+
+// ErrUniqueViolation is returned when an index value of a unique index
+// is already owned by another key.
+type ErrUniqueViolation struct {
+	Index    string
+	Value    []byte
+	Key      []byte
+	Conflict []byte
+}
+
+func (e *ErrUniqueViolation) Error() string {
+	return fmt.Sprintf("unique index %v violation: value %q of key %q is owned by key %q",
+		e.Index, e.Value, e.Key, e.Conflict)
+}
+
+//-----------------------------------------------------------------------------
+
+const indexUnique = "="
+
+func uniqueKey(hash string, index []byte) []byte {
+	return appendSegment(space(hash, indexUnique), index)
+}
+
+// deleteUnique deletes the guard of the index value in k2x key.
+func deleteUnique(txn *layer.Txn, ix *Index, k2x []byte) error {
+	_, index, err := splitIndexKey(k2x, ix.hash, indexK2X)
+	if err != nil {
+		return err
+	}
+	return txn.Delete(uniqueKey(ix.hash, index))
+}
+
+// claimUnique checks the guard of the index value and claims it for key.
+func claimUnique(txn *layer.Txn, ix *Index, key, index []byte) error {
+	guard := uniqueKey(ix.hash, index)
+	item, err := txn.Get(guard)
+	switch err {
+	case nil:
+		owner, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(owner, key) {
+			return &ErrUniqueViolation{
+				Index:    ix.name,
+				Value:    index,
+				Key:      key,
+				Conflict: owner,
+			}
+		}
+		return nil
+	case layer.ErrKeyNotFound:
+	default:
+		return err
+	}
+	return txn.Set(guard, key)
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,364 @@
+package peripheral
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/dc0d/positive/pkg/layer"
+)
+
+//-----------------------------------------------------------------------------
+
+// ProblemKind .
+type ProblemKind int
+
+// problem kinds
+const (
+	// Missing is an index entry of a document, which is not written,
+	// or the unique guard of it, which is not owned by the document.
+	Missing ProblemKind = iota + 1
+	// Stale is an index entry of a document, with a wrong value,
+	// or which is not an entry of the document anymore.
+	Stale
+	// Orphaned is an index entry of a document which does not exist,
+	// or a half of a K2X/X2K pair without the other half.
+	Orphaned
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case Missing:
+		return "missing"
+	case Stale:
+		return "stale"
+	case Orphaned:
+		return "orphaned"
+	}
+	return fmt.Sprintf("ProblemKind(%d)", int(k))
+}
+
+// Problem is an inconsistency between a document and an index.
+type Problem struct {
+	Index string
+	Kind  ProblemKind
+
+	// Key is the primary key of the document.
+	Key []byte
+	// IndexKey is the index key with the problem,
+	// it is nil for missing entries.
+	IndexKey []byte
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%v: %v entry of key %q: %q", p.Index, p.Kind, p.Key, p.IndexKey)
+}
+
+// Report is the result of Verify.
+type Report struct {
+	// Checked is the number of checked documents.
+	Checked  int
+	Problems []Problem
+
+	indexes []*Index
+}
+
+// OK reports if no problems are found.
+func (r *Report) OK() bool { return len(r.Problems) == 0 }
+
+//-----------------------------------------------------------------------------
+
+// Verify walks the primary keys and the index spaces of indexes, inside
+// a single read transaction, and reports missing, stale and orphaned
+// index entries - see Repair.
+func Verify(db *layer.DB, indexes ...*Index) (report *Report, reserr error) {
+	report = &Report{indexes: indexes}
+	reserr = db.View(func(txn *layer.Txn) error {
+		if err := verifyDocuments(txn, report); err != nil {
+			return err
+		}
+		for _, ix := range indexes {
+			if err := verifyOrphans(txn, ix, report); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// verifyBatchSize is the number of documents read at once by Verify,
+// before checking their entries - since only one iterator can be
+// open in a transaction.
+const verifyBatchSize = 300
+
+// verifyDocuments compares the expected entries of each document,
+// with the K2X and X2K entries of the document.
+func verifyDocuments(txn *layer.Txn, report *Report) error {
+	var seek []byte
+	for {
+		keys, vals, err := readDocuments(txn, seek, verifyBatchSize)
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			report.Checked++
+			for _, ix := range report.indexes {
+				if !ix.accepts(key) {
+					continue
+				}
+				if err := verifyDocument(txn, ix, key, vals[i], report); err != nil {
+					return err
+				}
+			}
+		}
+		if len(keys) < verifyBatchSize {
+			return nil
+		}
+		seek = append(keys[len(keys)-1], 0)
+	}
+}
+
+// readDocuments reads up to n documents, starting at seek,
+// skipping the reserved keyspaces.
+func readDocuments(txn *layer.Txn, seek []byte, n int) (keys, vals [][]byte, reserr error) {
+	itr := txn.NewIterator(layer.DefaultIteratorOptions)
+	defer itr.Close()
+	for itr.Seek(seek); itr.Valid() && len(keys) < n; itr.Next() {
+		item := itr.Item()
+		for pfx := reservedPrefix(item.Key()); pfx != nil; pfx = reservedPrefix(item.Key()) {
+			// skip the whole reserved keyspace
+			itr.Seek(successor(pfx))
+			if !itr.Valid() {
+				return
+			}
+			item = itr.Item()
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			reserr = err
+			return
+		}
+		keys = append(keys, item.KeyCopy(nil))
+		vals = append(vals, document(val))
+	}
+	return
+}
+
+func verifyDocument(txn *layer.Txn, ix *Index, key, val []byte, report *Report) error {
+	entries, err := ix.entries(key, val)
+	if err != nil {
+		return err
+	}
+	problem := func(kind ProblemKind, indexKey []byte) {
+		report.Problems = append(report.Problems, Problem{Index: ix.name, Kind: kind, Key: key, IndexKey: indexKey})
+	}
+
+	expected := make(map[string]bool)
+	for _, e := range entries {
+		k2x := k2xKey(ix.hash, key, e.index)
+		x2k := x2kKey(ix.hash, e.index, key)
+		expected[string(k2x)] = true
+
+		if ix.unique {
+			owner, err := getValue(txn, uniqueKey(ix.hash, e.index))
+			if err != nil {
+				return err
+			}
+			if owner == nil || !bytes.Equal(owner, key) {
+				problem(Missing, nil)
+			}
+		}
+
+		v, err := getValue(txn, k2x)
+		if err != nil {
+			return err
+		}
+		switch {
+		case v == nil:
+			problem(Missing, nil)
+			continue
+		case !bytes.Equal(v, x2k):
+			problem(Stale, k2x)
+			continue
+		}
+
+		v, err = getValue(txn, x2k)
+		if err != nil {
+			return err
+		}
+		switch {
+		case v == nil:
+			problem(Missing, nil)
+		case !bytes.Equal(v, e.val):
+			problem(Stale, x2k)
+		}
+	}
+
+	opt := layer.DefaultIteratorOptions
+	opt.PrefetchValues = false
+	itr := txn.NewIterator(opt)
+	defer itr.Close()
+	prefix := k2xPrefix(ix.hash, key)
+	for itr.Seek(prefix); itr.ValidForPrefix(prefix); itr.Next() {
+		k := itr.Item().KeyCopy(nil)
+		if !expected[string(k)] {
+			problem(Stale, k)
+		}
+	}
+	return nil
+}
+
+// verifyOrphans finds the index entries of documents which do not exist,
+// and X2K (and unique guard) entries which have no K2X entry.
+func verifyOrphans(txn *layer.Txn, ix *Index, report *Report) error {
+	problem := func(key, indexKey []byte) {
+		report.Problems = append(report.Problems, Problem{Index: ix.name, Kind: Orphaned, Key: key, IndexKey: indexKey})
+	}
+
+	for _, domain := range []string{indexK2X, indexX2K, indexUnique} {
+		itr := txn.NewIterator(layer.DefaultIteratorOptions)
+		prefix := space(ix.hash, domain)
+		err := func() error {
+			defer itr.Close()
+			for itr.Seek(prefix); itr.ValidForPrefix(prefix); itr.Next() {
+				item := itr.Item()
+				k := item.KeyCopy(nil)
+
+				var key, index []byte
+				var err error
+				switch domain {
+				case indexK2X:
+					key, _, err = splitIndexKey(k, ix.hash, domain)
+				case indexX2K:
+					index, key, err = splitIndexKey(k, ix.hash, domain)
+				case indexUnique:
+					index, _, err = readSegment(k[len(prefix):])
+					if err == nil {
+						key, err = item.ValueCopy(nil)
+					}
+				}
+				if err != nil {
+					problem(nil, k)
+					continue
+				}
+
+				doc, err := getValue(txn, key)
+				if err != nil {
+					return err
+				}
+				if doc == nil {
+					problem(key, k)
+					continue
+				}
+				if domain == indexK2X {
+					// the document exists, so it is verified by verifyDocument
+					continue
+				}
+
+				x2k, err := getValue(txn, k2xKey(ix.hash, key, index))
+				if err != nil {
+					return err
+				}
+				if x2k == nil || (domain == indexX2K && !bytes.Equal(x2k, k)) {
+					problem(key, k)
+				}
+			}
+			return nil
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getValue returns the value of key, or nil if it does not exist.
+func getValue(txn *layer.Txn, key []byte) ([]byte, error) {
+	item, err := txn.Get(key)
+	if err == layer.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	return document(v), nil
+}
+
+//-----------------------------------------------------------------------------
+
+// Repair fixes the problems of report in batches of batchSize, each batch
+// inside its own transaction. Indexes of documents with missing or stale
+// entries are emitted again, and orphaned entries are deleted.
+// It is safe to run Verify and Repair again after an interruption.
+func Repair(db *layer.DB, report *Report, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = 300
+	}
+	indexes := make(map[string]*Index)
+	for _, ix := range report.indexes {
+		indexes[ix.name] = ix
+	}
+
+	type task struct {
+		ix            *Index
+		key, indexKey []byte
+	}
+	// orphaned entries are deleted first, so emitting again
+	// the entries of a document does not get undone.
+	var deletes, emits []task
+	emitted := make(map[string]bool)
+	for _, p := range report.Problems {
+		ix := indexes[p.Index]
+		if ix == nil {
+			continue
+		}
+		if p.Kind == Orphaned {
+			deletes = append(deletes, task{ix: ix, indexKey: p.IndexKey})
+			continue
+		}
+		id := p.Index + "\x00" + string(p.Key)
+		if emitted[id] {
+			continue
+		}
+		emitted[id] = true
+		emits = append(emits, task{ix: ix, key: p.Key})
+	}
+
+	tasks := append(deletes, emits...)
+	for len(tasks) > 0 {
+		n := batchSize
+		if n > len(tasks) {
+			n = len(tasks)
+		}
+		batch := tasks[:n]
+		tasks = tasks[n:]
+		err := maintain(db, func(txn *layer.Txn) error {
+			for _, t := range batch {
+				if t.indexKey != nil {
+					if err := txn.Delete(t.indexKey); err != nil {
+						return err
+					}
+					continue
+				}
+				doc, err := getValue(txn, t.key)
+				if err != nil {
+					return err
+				}
+				if err := Emit(txn, t.ix, t.key, doc); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
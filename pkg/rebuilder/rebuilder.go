@@ -64,8 +64,38 @@ type Rebuilder struct {
 // passed indexBuilder.
 func (rr *Rebuilder) Index() *peripheral.Index { return rr.rebuilderIndex }
 
-// Rebuild .
-func (rr *Rebuilder) Rebuild(indexBuilder layer.BeforeCommit) error {
+// Pending returns the defined indexes which are still building,
+// and need a Rebuild.
+func (rr *Rebuilder) Pending() (pending []peripheral.IndexInfo, reserr error) {
+	reserr = rr.db.View(func(txn *layer.Txn) error {
+		list, err := peripheral.ListIndexes(txn)
+		if err != nil {
+			return err
+		}
+		for _, v := range list {
+			if v.State == peripheral.Building {
+				pending = append(pending, v)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Rebuild rewrites documents stored with previous database versions.
+// indexBuilder can be nil, if indexes are maintained by hooks
+// registered on the database (like a peripheral.Registry).
+//
+// Pending indexes (defined before Rebuild) which are passed in indexes,
+// are emitted for all documents and marked as ready afterwards - other
+// pending indexes stay building, since rewritten documents are not
+// all documents.
+func (rr *Rebuilder) Rebuild(indexBuilder layer.BeforeCommit, indexes ...*peripheral.Index) error {
+	pending, err := rr.Pending()
+	if err != nil {
+		return err
+	}
+
 	var ver uint64
 	for ver = 0; ver < rr.dbVersion; ver++ {
 		b := make([]byte, 8)
@@ -76,27 +106,22 @@ func (rr *Rebuilder) Rebuild(indexBuilder layer.BeforeCommit) error {
 		for cnt > 0 {
 			err := rr.db.UpdateWith(func(txn *layer.Txn) error {
 				res, _, err := peripheral.QueryIndex(peripheral.Q{
-					Index:  rr.indexName,
-					Limit:  rr.batchSize,
-					Start:  []byte(start),
-					Prefix: []byte(start),
-					End:    []byte(rr.header + ":\uffff"),
+					Index:          rr.indexName,
+					Limit:          rr.batchSize,
+					Start:          []byte(start),
+					Prefix:         []byte(start),
+					End:            []byte(rr.header + ":\uffff"),
+					FetchDocuments: true,
 				}, txn)
 				if err != nil {
 					return err
 				}
 				cnt = len(res)
 				for _, v := range res {
-					itm, err := txn.Get(v.Key)
-					if err != nil {
-						return err
-					}
-					k := itm.KeyCopy(nil)
-					v, err := itm.ValueCopy(nil)
-					if err != nil {
-						return err
+					if v.Doc == nil {
+						return layer.ErrKeyNotFound
 					}
-					if err := txn.Set(k, v); err != nil {
+					if err := txn.Set(v.Key, v.Doc); err != nil {
 						return err
 					}
 				}
@@ -107,5 +132,18 @@ func (rr *Rebuilder) Rebuild(indexBuilder layer.BeforeCommit) error {
 			}
 		}
 	}
+	byName := make(map[string]*peripheral.Index, len(indexes))
+	for _, ix := range indexes {
+		byName[ix.Name()] = ix
+	}
+	for _, v := range pending {
+		ix, ok := byName[v.Name]
+		if !ok {
+			continue
+		}
+		if err := peripheral.BuildIndex(rr.db, rr.batchSize, ix); err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -6,12 +6,14 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/dc0d/positive/pkg/layer"
 	"github.com/dc0d/positive/pkg/peripheral"
+	"github.com/dc0d/positive/pkg/peripheral/keyenc"
 	"github.com/stretchr/testify/require"
 )
 
@@ -76,30 +78,18 @@ func TestEmit_simple(t *testing.T) {
 
 	var (
 		dbVersion  uint64 = 1
-		indices    []*peripheral.Index
 		_rebuilder *Rebuilder
 	)
 
-	indexBuilder := func(txn *layer.Txn, entries map[string][]byte) error {
-		for k, v := range entries {
-			// all indexes must be built here,
-			// based on document type (v), etc, etc.
-
-			for _, ix := range indices {
-				if err := peripheral.Emit(txn, ix, []byte(k), v); err != nil {
-					return err
-				}
-			}
-		}
-		return nil
-	}
+	registry := peripheral.NewRegistry()
+	registry.Attach(db)
 
 	initIndices := func() {
 		_rebuilder = New(Options{
 			DB:        db,
 			DBVersion: dbVersion,
 		})
-		indices = append(indices, _rebuilder.Index())
+		require.NoError(registry.Register(_rebuilder.Index()))
 	}
 	initIndices()
 
@@ -113,13 +103,13 @@ func TestEmit_simple(t *testing.T) {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				err := db.UpdateWith(func(txn *layer.Txn) error {
+				err := db.UpdateRetry(layer.RetryOptions{}, func(txn *layer.Txn) error {
 					js, err := json.Marshal(&d)
 					if err != nil {
 						return err
 					}
 					return txn.Set([]byte(d.ID), js)
-				}, indexBuilder)
+				})
 				require.NoError(err)
 			}()
 		}
@@ -153,14 +143,12 @@ func TestEmit_simple(t *testing.T) {
 			if d.At.IsZero() {
 				d.At = time.Now()
 			}
-			ix := d.At.Format(time.RFC3339)
-			entries = append(entries, peripheral.IndexEntry{Index: []byte(ix)})
+			entries = append(entries, peripheral.IndexEntry{Index: keyenc.Time(d.At)})
 			return
 		})
 
-		indices = append(indices, _rebuilder.Index())
-		_ = indexTime
-		indices = append(indices, indexTime)
+		registry.Unregister(_rebuilder.Index().Name())
+		require.NoError(registry.Register(_rebuilder.Index(), indexTime))
 	}
 	initIndices()
 
@@ -179,7 +167,7 @@ func TestEmit_simple(t *testing.T) {
 	})
 	require.Equal(40, cnt)
 
-	require.NoError(_rebuilder.Rebuild(indexBuilder))
+	require.NoError(_rebuilder.Rebuild(nil))
 
 	cnt = 0
 	db.View(func(txn *layer.Txn) error {
@@ -194,3 +182,101 @@ func TestEmit_simple(t *testing.T) {
 	})
 	require.Equal(50, cnt)
 }
+
+func TestPending(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	registry := peripheral.NewRegistry()
+	registry.Attach(db)
+
+	_rebuilder := New(Options{DB: db, DBVersion: 1})
+	require.NoError(registry.Register(_rebuilder.Index()))
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		if err := txn.Set([]byte("D:1"), []byte("text")); err != nil {
+			return err
+		}
+		// an empty document
+		return txn.Set([]byte("D:2"), []byte{})
+	}))
+
+	_rebuilder = New(Options{DB: db, DBVersion: 2})
+	indexLen := peripheral.NewIndex("len", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: keyenc.Int64(int64(len(val)))})
+		return
+	})
+	registry.Unregister(_rebuilder.Index().Name())
+	require.NoError(registry.Register(_rebuilder.Index(), indexLen))
+	require.NoError(peripheral.DefineIndex(db, indexLen))
+
+	pending, err := _rebuilder.Pending()
+	require.NoError(err)
+	require.Equal(1, len(pending))
+	require.Equal("len", pending[0].Name)
+
+	require.NoError(_rebuilder.Rebuild(nil))
+
+	pending, err = _rebuilder.Pending()
+	require.NoError(err)
+	require.Equal(1, len(pending))
+
+	require.NoError(_rebuilder.Rebuild(nil, indexLen))
+
+	pending, err = _rebuilder.Pending()
+	require.NoError(err)
+	require.Empty(pending)
+
+	require.NoError(db.View(func(txn *layer.Txn) error {
+		_, n, err := peripheral.QueryIndex(peripheral.Q{Index: "len", Count: true}, txn)
+		require.NoError(err)
+		require.Equal(2, n)
+		return nil
+	}))
+}
+
+func TestPending_sameVersion(t *testing.T) {
+	require := require.New(t)
+
+	db := createDB("", false)
+	defer db.Close()
+
+	registry := peripheral.NewRegistry()
+	registry.Attach(db)
+
+	_rebuilder := New(Options{DB: db, DBVersion: 1, BatchSize: 7})
+	require.NoError(registry.Register(_rebuilder.Index()))
+	require.NoError(db.Update(func(txn *layer.Txn) error {
+		for i := 0; i < 20; i++ {
+			if err := txn.Set([]byte(fmt.Sprintf("D:%02d", i)), []byte(strings.Repeat("x", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	indexLen := peripheral.NewIndex("len", func(key, val []byte) (entries []peripheral.IndexEntry, err error) {
+		entries = append(entries, peripheral.IndexEntry{Index: keyenc.Int64(int64(len(val)))})
+		return
+	})
+	require.NoError(registry.Register(indexLen))
+	require.NoError(peripheral.DefineIndex(db, indexLen))
+
+	require.NoError(_rebuilder.Rebuild(nil, indexLen))
+
+	pending, err := _rebuilder.Pending()
+	require.NoError(err)
+	require.Empty(pending)
+
+	require.NoError(db.View(func(txn *layer.Txn) error {
+		_, n, err := peripheral.QueryIndex(peripheral.Q{Index: "len", Count: true}, txn)
+		require.NoError(err)
+		require.Equal(20, n)
+		return nil
+	}))
+
+	report, err := peripheral.Verify(db, indexLen)
+	require.NoError(err)
+	require.True(report.OK(), fmt.Sprint(report.Problems))
+}